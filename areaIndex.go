@@ -0,0 +1,147 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// areaIndexNodeSize is the number of children of each node of the R-tree.
+const areaIndexNodeSize = 16
+
+// areaIndex answers whether a point is within any of a set of bounding boxes
+// and polygons.  Large sets are held in an R-tree, packed once with the
+// Sort-Tile-Recursive algorithm, so that a lookup visits only the few boxes
+// near the point instead of every one of them.
+type areaIndex struct {
+	boundingBoxes [][]float64
+	polygons      []polygon
+	root          *areaIndexNode
+}
+
+// areaIndexNode is an R-tree node.  Leaves refer to the entry at item, which
+// counts the bounding boxes first and then the polygons.
+type areaIndexNode struct {
+	boundingBox [4]float64
+	children    []*areaIndexNode
+	item        int
+}
+
+func newAreaIndex(boundingBoxes [][]float64, polygons []polygon) *areaIndex {
+	index := &areaIndex{boundingBoxes: boundingBoxes, polygons: polygons}
+	if len(boundingBoxes)+len(polygons) <= areaIndexNodeSize {
+		// a scan is as quick as a lookup for a handful of areas
+		return index
+	}
+
+	leaves := make([]*areaIndexNode, 0, len(boundingBoxes)+len(polygons))
+	for i, boundingBox := range boundingBoxes {
+		if boundingBox != nil {
+			leaves = append(leaves, &areaIndexNode{[4]float64{boundingBox[0], boundingBox[1], boundingBox[2], boundingBox[3]}, nil, i})
+		}
+	}
+	for i := range polygons {
+		boundingBox := polygons[i].boundingBox
+		leaves = append(leaves, &areaIndexNode{[4]float64{boundingBox[0], boundingBox[1], boundingBox[2], boundingBox[3]}, nil, len(boundingBoxes) + i})
+	}
+	if len(leaves) == 0 {
+		return index
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		level = packAreaIndexLevel(level)
+	}
+	index.root = level[0]
+	return index
+}
+
+// packAreaIndexLevel groups nodes into parents of areaIndexNodeSize children:
+// the nodes are cut into vertical slices by longitude, and each slice into
+// runs by latitude, so that each parent covers a compact area.
+func packAreaIndexLevel(nodes []*areaIndexNode) []*areaIndexNode {
+	parentCount := (len(nodes) + areaIndexNodeSize - 1) / areaIndexNodeSize
+	sliceCount := int(math.Ceil(math.Sqrt(float64(parentCount))))
+	sliceSize := sliceCount * areaIndexNodeSize
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].boundingBox[0]+nodes[i].boundingBox[2] < nodes[j].boundingBox[0]+nodes[j].boundingBox[2]
+	})
+
+	parents := make([]*areaIndexNode, 0, parentCount)
+	for sliceStart := 0; sliceStart < len(nodes); sliceStart += sliceSize {
+		slice := nodes[sliceStart:minInt(sliceStart+sliceSize, len(nodes))]
+		sort.Slice(slice, func(i, j int) bool {
+			return slice[i].boundingBox[1]+slice[i].boundingBox[3] < slice[j].boundingBox[1]+slice[j].boundingBox[3]
+		})
+
+		for groupStart := 0; groupStart < len(slice); groupStart += areaIndexNodeSize {
+			children := slice[groupStart:minInt(groupStart+areaIndexNodeSize, len(slice))]
+			parent := &areaIndexNode{children[0].boundingBox, children, -1}
+			for _, child := range children[1:] {
+				parent.boundingBox[0] = math.Min(parent.boundingBox[0], child.boundingBox[0])
+				parent.boundingBox[1] = math.Min(parent.boundingBox[1], child.boundingBox[1])
+				parent.boundingBox[2] = math.Max(parent.boundingBox[2], child.boundingBox[2])
+				parent.boundingBox[3] = math.Max(parent.boundingBox[3], child.boundingBox[3])
+			}
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// contains is safe for concurrent use.
+func (index *areaIndex) contains(lon float64, lat float64) bool {
+	if index.root == nil {
+		return isInBoundingBoxes(index.boundingBoxes, lon, lat) || isInPolygons(index.polygons, lon, lat)
+	}
+
+	stack := make([]*areaIndexNode, 1, 32)
+	stack[0] = index.root
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		box := &node.boundingBox
+		if lon < box[0] || lat < box[1] || lon > box[2] || lat > box[3] {
+			continue
+		}
+		if node.children != nil {
+			stack = append(stack, node.children...)
+			continue
+		}
+
+		// a leaf's bounding box is the whole test for a bounding box entry
+		if node.item < len(index.boundingBoxes) {
+			return true
+		}
+		if index.polygons[node.item-len(index.boundingBoxes)].contains(lon, lat) {
+			return true
+		}
+	}
+	return false
+}
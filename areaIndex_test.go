@@ -0,0 +1,108 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// randomBoundingBoxes makes boxes of up to about 1km across, scattered over
+// an area the size of a small country.
+func randomBoundingBoxes(random *rand.Rand, count int) [][]float64 {
+	boundingBoxes := make([][]float64, count)
+	for i := range boundingBoxes {
+		lon := random.Float64() * 5
+		lat := 45 + random.Float64()*5
+		boundingBoxes[i] = []float64{lon, lat, lon + random.Float64()*0.01, lat + random.Float64()*0.01}
+	}
+	return boundingBoxes
+}
+
+func randomPolygons(random *rand.Rand, count int) []polygon {
+	polygons := make([]polygon, count)
+	for i := range polygons {
+		lon := random.Float64() * 5
+		lat := 45 + random.Float64()*5
+		size := random.Float64() * 0.01
+		polygons[i] = newPolygon(ring{{lon, lat}, {lon + size, lat}, {lon, lat + size}}, nil)
+	}
+	return polygons
+}
+
+func TestAreaIndexMatchesScan(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, count := range []int{0, 1, areaIndexNodeSize, areaIndexNodeSize + 1, 1000} {
+		boundingBoxes := randomBoundingBoxes(random, count)
+		if count > 0 {
+			boundingBoxes[0] = nil
+		}
+		polygons := randomPolygons(random, count/2)
+		index := newAreaIndex(boundingBoxes, polygons)
+
+		for i := 0; i < 100000; i++ {
+			lon := random.Float64() * 5
+			lat := 45 + random.Float64()*5
+			expected := isInBoundingBoxes(boundingBoxes, lon, lat) || isInPolygons(polygons, lon, lat)
+			if index.contains(lon, lat) != expected {
+				t.Fatalf("%d areas: contains(%v, %v) should be %v", count, lon, lat, expected)
+			}
+		}
+
+		// points inside every box must be found
+		for _, boundingBox := range boundingBoxes {
+			if boundingBox != nil && !index.contains(boundingBox[2], boundingBox[3]) {
+				t.Fatalf("%d areas: corner of %v not found", count, boundingBox)
+			}
+		}
+	}
+}
+
+func benchmarkBoundingBoxLookup(b *testing.B, count int, contains func(boundingBoxes [][]float64) func(lon, lat float64) bool) {
+	random := rand.New(rand.NewSource(1))
+	lookup := contains(randomBoundingBoxes(random, count))
+	points := make([][2]float64, 1024)
+	for i := range points {
+		points[i] = [2]float64{random.Float64() * 5, 45 + random.Float64()*5}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		point := points[i%len(points)]
+		lookup(point[0], point[1])
+	}
+}
+
+func scanLookup(boundingBoxes [][]float64) func(lon, lat float64) bool {
+	return func(lon, lat float64) bool {
+		return isInBoundingBoxes(boundingBoxes, lon, lat)
+	}
+}
+
+func indexLookup(boundingBoxes [][]float64) func(lon, lat float64) bool {
+	return newAreaIndex(boundingBoxes, nil).contains
+}
+
+func BenchmarkScan10(b *testing.B)     { benchmarkBoundingBoxLookup(b, 10, scanLookup) }
+func BenchmarkScan1000(b *testing.B)   { benchmarkBoundingBoxLookup(b, 1000, scanLookup) }
+func BenchmarkScan100000(b *testing.B) { benchmarkBoundingBoxLookup(b, 100000, scanLookup) }
+
+func BenchmarkAreaIndex10(b *testing.B)     { benchmarkBoundingBoxLookup(b, 10, indexLookup) }
+func BenchmarkAreaIndex1000(b *testing.B)   { benchmarkBoundingBoxLookup(b, 1000, indexLookup) }
+func BenchmarkAreaIndex100000(b *testing.B) { benchmarkBoundingBoxLookup(b, 100000, indexLookup) }
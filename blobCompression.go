@@ -0,0 +1,138 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"OSMPBF"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz/lzma"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// blobCompression is a compression method for output blobs, with a level
+// for the methods that have one.
+type blobCompression struct {
+	method string
+	level  int
+}
+
+// outputCompression is used for every blob written to the output file.
+var outputCompression = blobCompression{"zlib", zlib.DefaultCompression}
+
+var zstdEncoder *zstd.Encoder
+var zstdEncoderErr error
+var zstdEncoderOnce sync.Once
+
+// parseBlobCompression parses a -compression value: none, lzma, or zlib and
+// zstd optionally followed by a level, as in zlib:9 or zstd:19.
+func parseBlobCompression(value string) (blobCompression, error) {
+	method, levelText := value, ""
+	if i := strings.IndexByte(value, ':'); i != -1 {
+		method, levelText = value[:i], value[i+1:]
+	}
+
+	var compression blobCompression
+	var minLevel, maxLevel int
+	switch method {
+	case "none", "lzma":
+		if levelText != "" {
+			return compression, errors.New(method + " does not take a compression level")
+		}
+		return blobCompression{method, 0}, nil
+	case "zlib":
+		compression = blobCompression{method, zlib.DefaultCompression}
+		minLevel, maxLevel = zlib.NoCompression, zlib.BestCompression
+	case "zstd":
+		compression = blobCompression{method, 3}
+		minLevel, maxLevel = 1, 22
+	default:
+		return compression, errors.New("unknown compression method " + method)
+	}
+
+	if levelText != "" {
+		level, err := strconv.Atoi(levelText)
+		if err != nil || level < minLevel || level > maxLevel {
+			return compression, errors.New(method + " compression level must be between " + strconv.Itoa(minLevel) + " and " + strconv.Itoa(maxLevel))
+		}
+		compression.level = level
+	}
+	return compression, nil
+}
+
+// compressBlob wraps the marshalled content of a block in a Blob, compressed
+// as selected by outputCompression.
+func compressBlob(blobContent []byte) (*OSMPBF.Blob, error) {
+	blob := &OSMPBF.Blob{}
+	if outputCompression.method == "none" {
+		blob.Raw = blobContent
+		return blob, nil
+	}
+
+	var blobContentLength int32 = int32(len(blobContent))
+	blob.RawSize = &blobContentLength
+
+	switch outputCompression.method {
+	case "zlib":
+		var compressedBlob bytes.Buffer
+		zlibWriter, err := zlib.NewWriterLevel(&compressedBlob, outputCompression.level)
+		if err != nil {
+			return nil, err
+		}
+		zlibWriter.Write(blobContent)
+		err = zlibWriter.Close()
+		if err != nil {
+			return nil, err
+		}
+		blob.ZlibData = compressedBlob.Bytes()
+
+	case "lzma":
+		var compressedBlob bytes.Buffer
+		lzmaWriter, err := lzma.NewWriter(&compressedBlob)
+		if err != nil {
+			return nil, err
+		}
+		lzmaWriter.Write(blobContent)
+		err = lzmaWriter.Close()
+		if err != nil {
+			return nil, err
+		}
+		blob.LzmaData = compressedBlob.Bytes()
+
+	case "zstd":
+		// a single encoder is safe for concurrent use through EncodeAll
+		zstdEncoderOnce.Do(func() {
+			level := zstd.EncoderLevelFromZstd(outputCompression.level)
+			zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+		})
+		if zstdEncoderErr != nil {
+			return nil, zstdEncoderErr
+		}
+		blob.ZstdData = zstdEncoder.EncodeAll(blobContent, nil)
+
+	default:
+		return nil, errors.New("unknown compression method " + outputCompression.method)
+	}
+
+	return blob, nil
+}
@@ -0,0 +1,105 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// blockWriter marshals and compresses blocks on several goroutines, and
+// writes them to a file in the order they were queued.
+type blockWriter struct {
+	file  io.Writer
+	queue chan chan encodedBlock
+	done  chan bool
+
+	errLock sync.Mutex
+	err     error
+}
+
+type encodedBlock struct {
+	data []byte
+	err  error
+}
+
+func newBlockWriter(file io.Writer) *blockWriter {
+	// the queue length bounds the number of blocks held in memory at once
+	writer := &blockWriter{
+		file:  file,
+		queue: make(chan chan encodedBlock, runtime.NumCPU()*2),
+		done:  make(chan bool),
+	}
+	go writer.writeQueuedBlocks()
+	return writer
+}
+
+// write queues block for output, waiting while the queue is full.  The block
+// must not be modified afterwards.  An error from an earlier block is
+// returned, in which case nothing more is written.
+func (writer *blockWriter) write(block proto.Message, blockType string) error {
+	err := writer.error()
+	if err != nil {
+		return err
+	}
+
+	result := make(chan encodedBlock, 1)
+	writer.queue <- result
+	go func() {
+		data, err := encodeBlock(block, blockType)
+		result <- encodedBlock{data, err}
+	}()
+	return nil
+}
+
+// close waits until every queued block is written, returning the first
+// error encountered.
+func (writer *blockWriter) close() error {
+	close(writer.queue)
+	<-writer.done
+	return writer.error()
+}
+
+func (writer *blockWriter) error() error {
+	writer.errLock.Lock()
+	defer writer.errLock.Unlock()
+	return writer.err
+}
+
+func (writer *blockWriter) writeQueuedBlocks() {
+	for result := range writer.queue {
+		encoded := <-result
+		if writer.error() != nil {
+			continue
+		}
+
+		err := encoded.err
+		if err == nil {
+			_, err = writer.file.Write(encoded.data)
+		}
+		if err != nil {
+			writer.errLock.Lock()
+			writer.err = err
+			writer.errLock.Unlock()
+		}
+	}
+	close(writer.done)
+}
@@ -0,0 +1,206 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// idSet is a set of OSM ids.  Every id is added before the set is first
+// queried; from then on contains is safe for concurrent use.  close releases
+// the set's memory, and any file behind it.
+type idSet interface {
+	add(id int64)
+	contains(id int64) bool
+	close()
+}
+
+// idSetKind selects the idSet implementation made by newIdSet:
+//
+//	map      a Go map; quickest, but around 40 bytes per id
+//	sorted   a sorted array; 8 bytes per id, with a binary search per lookup
+//	bitmap   a bit per id in 64Ki-id chunks; smallest for dense id ranges,
+//	         and up to 8KiB per id for scattered ones
+//	mmap     a bit per id in a memory-mapped file, which the operating system
+//	         keeps on disk when memory runs short
+var idSetKind = "map"
+
+func checkIdSetKind(kind string) error {
+	switch kind {
+	case "map", "sorted", "bitmap", "mmap":
+		return nil
+	}
+	return errors.New("unknown id set kind " + kind)
+}
+
+// newIdSet makes an empty set of the kind selected by idSetKind, sized for
+// about capacity ids.
+func newIdSet(capacity int) (idSet, error) {
+	switch idSetKind {
+	case "sorted":
+		return &sortedIdSet{ids: make([]int64, 0, capacity)}, nil
+	case "bitmap":
+		return &bitmapIdSet{make(map[int64]*bitmapChunk)}, nil
+	case "mmap":
+		return newMappedIdSet()
+	}
+	return make(mapIdSet, capacity), nil
+}
+
+type mapIdSet map[int64]bool
+
+func (set mapIdSet) add(id int64) {
+	set[id] = true
+}
+
+func (set mapIdSet) contains(id int64) bool {
+	return set[id]
+}
+
+func (set mapIdSet) close() {
+}
+
+type sortedIdSet struct {
+	ids      []int64
+	sortOnce sync.Once
+	sorted   bool
+}
+
+func (set *sortedIdSet) add(id int64) {
+	if set.sorted {
+		panic("id added to a sortedIdSet after it was queried")
+	}
+	set.ids = append(set.ids, id)
+}
+
+func (set *sortedIdSet) contains(id int64) bool {
+	set.sortOnce.Do(set.sort)
+
+	ids := set.ids
+	low, high := 0, len(ids)
+	for low < high {
+		middle := int(uint(low+high) >> 1)
+		if ids[middle] < id {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+	return low < len(ids) && ids[low] == id
+}
+
+func (set *sortedIdSet) close() {
+}
+
+// sort orders the ids and drops duplicates.
+func (set *sortedIdSet) sort() {
+	ids := set.ids
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	unique := 0
+	for i, id := range ids {
+		if i == 0 || id != ids[unique-1] {
+			ids[unique] = id
+			unique += 1
+		}
+	}
+	set.ids = ids[:unique]
+	set.sorted = true
+}
+
+const bitmapChunkBits = 16
+
+type bitmapChunk [(1 << bitmapChunkBits) / 64]uint64
+
+type bitmapIdSet struct {
+	chunks map[int64]*bitmapChunk
+}
+
+func (set *bitmapIdSet) add(id int64) {
+	chunk := set.chunks[id>>bitmapChunkBits]
+	if chunk == nil {
+		chunk = &bitmapChunk{}
+		set.chunks[id>>bitmapChunkBits] = chunk
+	}
+	bit := id & (1<<bitmapChunkBits - 1)
+	chunk[bit/64] |= 1 << uint(bit%64)
+}
+
+func (set *bitmapIdSet) contains(id int64) bool {
+	chunk := set.chunks[id>>bitmapChunkBits]
+	if chunk == nil {
+		return false
+	}
+	bit := id & (1<<bitmapChunkBits - 1)
+	return chunk[bit/64]&(1<<uint(bit%64)) != 0
+}
+
+func (set *bitmapIdSet) close() {
+}
+
+// wayNodeIndex maps node ids to the indexes of the ways that use them, in a
+// pair of arrays sorted by node id.
+type wayNodeIndex struct {
+	nodeIds    []int64
+	wayIndexes []int32
+}
+
+func newWayNodeIndex(wayNodeRefs [][]int64) *wayNodeIndex {
+	count := 0
+	for _, nodeIds := range wayNodeRefs {
+		count += len(nodeIds)
+	}
+
+	index := &wayNodeIndex{make([]int64, 0, count), make([]int32, 0, count)}
+	for wayIndex, nodeIds := range wayNodeRefs {
+		for _, nodeId := range nodeIds {
+			index.nodeIds = append(index.nodeIds, nodeId)
+			index.wayIndexes = append(index.wayIndexes, int32(wayIndex))
+		}
+	}
+	sort.Sort(index)
+	return index
+}
+
+func (index *wayNodeIndex) Len() int {
+	return len(index.nodeIds)
+}
+
+func (index *wayNodeIndex) Less(i int, j int) bool {
+	return index.nodeIds[i] < index.nodeIds[j]
+}
+
+func (index *wayNodeIndex) Swap(i int, j int) {
+	index.nodeIds[i], index.nodeIds[j] = index.nodeIds[j], index.nodeIds[i]
+	index.wayIndexes[i], index.wayIndexes[j] = index.wayIndexes[j], index.wayIndexes[i]
+}
+
+// owners returns the indexes of the ways using nodeId, which may repeat when
+// a way uses the node more than once, as closed ways do.
+func (index *wayNodeIndex) owners(nodeId int64) []int32 {
+	nodeIds := index.nodeIds
+	first := sort.Search(len(nodeIds), func(i int) bool { return nodeIds[i] >= nodeId })
+	last := first
+	for last < len(nodeIds) && nodeIds[last] == nodeId {
+		last += 1
+	}
+	return index.wayIndexes[first:last]
+}
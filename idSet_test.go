@@ -0,0 +1,157 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+var idSetKinds = []string{"map", "sorted", "bitmap", "mmap"}
+
+func newIdSetOfKind(tb testing.TB, kind string, capacity int) idSet {
+	defer func(previousKind string) { idSetKind = previousKind }(idSetKind)
+	idSetKind = kind
+	set, err := newIdSet(capacity)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return set
+}
+
+func TestIdSets(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	ids := make(map[int64]bool)
+	for i := 0; i < 10000; i++ {
+		ids[random.Int63n(1<<34)-1<<20] = true
+	}
+	ids[0] = true
+	ids[-1] = true
+
+	for _, kind := range idSetKinds {
+		set := newIdSetOfKind(t, kind, len(ids))
+		for id := range ids {
+			set.add(id)
+			set.add(id)
+		}
+
+		for id := range ids {
+			if !set.contains(id) {
+				t.Fatalf("%s set is missing %d", kind, id)
+			}
+			if !ids[id+1] && set.contains(id+1) {
+				t.Fatalf("%s set wrongly contains %d", kind, id+1)
+			}
+		}
+		for i := 0; i < 10000; i++ {
+			id := random.Int63()
+			if set.contains(id) != ids[id] {
+				t.Fatalf("%s set contains(%d) should be %v", kind, id, ids[id])
+			}
+		}
+		set.close()
+	}
+}
+
+func TestWayNodeIndex(t *testing.T) {
+	index := newWayNodeIndex([][]int64{{1, 2, 3, 1}, {3, 4}, {}, {5}})
+
+	expected := map[int64][]int32{1: {0, 0}, 2: {0}, 3: {0, 1}, 4: {1}, 5: {3}, 6: nil, 0: nil}
+	for nodeId, wayIndexes := range expected {
+		owners := index.owners(nodeId)
+		if len(owners) != len(wayIndexes) {
+			t.Fatalf("owners(%d) = %v, expected %v", nodeId, owners, wayIndexes)
+		}
+		seen := make(map[int32]int)
+		for _, wayIndex := range owners {
+			seen[wayIndex] += 1
+		}
+		for _, wayIndex := range wayIndexes {
+			seen[wayIndex] -= 1
+		}
+		for wayIndex, count := range seen {
+			if count != 0 {
+				t.Fatalf("owners(%d) = %v, expected %v (way %d)", nodeId, owners, wayIndexes, wayIndex)
+			}
+		}
+	}
+}
+
+// benchmarkIdSetMemory reports the heap used per id by sets of a million
+// node ids, either spread over the whole id range or in one dense run, as
+// they would be for a scattered or a regional extract.  Memory-mapped sets
+// live outside the Go heap, in the page cache, so they report next to none.
+func benchmarkIdSetMemory(b *testing.B, kind string, dense bool) {
+	random := rand.New(rand.NewSource(1))
+	ids := make([]int64, 1000000)
+	for i := range ids {
+		if dense {
+			ids[i] = 3000000000 + int64(i)*2
+		} else {
+			ids[i] = random.Int63n(10000000000)
+		}
+	}
+
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		set := newIdSetOfKind(b, kind, len(ids))
+		for _, id := range ids {
+			set.add(id)
+		}
+		set.contains(0)
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(len(ids)), "bytes/id")
+		set.close()
+	}
+}
+
+func BenchmarkIdSetMemoryMapScattered(b *testing.B)    { benchmarkIdSetMemory(b, "map", false) }
+func BenchmarkIdSetMemorySortedScattered(b *testing.B) { benchmarkIdSetMemory(b, "sorted", false) }
+func BenchmarkIdSetMemoryBitmapScattered(b *testing.B) { benchmarkIdSetMemory(b, "bitmap", false) }
+func BenchmarkIdSetMemoryMmapScattered(b *testing.B)   { benchmarkIdSetMemory(b, "mmap", false) }
+func BenchmarkIdSetMemoryMapDense(b *testing.B)        { benchmarkIdSetMemory(b, "map", true) }
+func BenchmarkIdSetMemorySortedDense(b *testing.B)     { benchmarkIdSetMemory(b, "sorted", true) }
+func BenchmarkIdSetMemoryBitmapDense(b *testing.B)     { benchmarkIdSetMemory(b, "bitmap", true) }
+func BenchmarkIdSetMemoryMmapDense(b *testing.B)       { benchmarkIdSetMemory(b, "mmap", true) }
+
+func benchmarkIdSetLookup(b *testing.B, kind string) {
+	random := rand.New(rand.NewSource(1))
+	set := newIdSetOfKind(b, kind, 1000000)
+	defer set.close()
+	for i := 0; i < 1000000; i++ {
+		set.add(random.Int63n(10000000000))
+	}
+	set.contains(0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.contains(random.Int63n(10000000000))
+	}
+}
+
+func BenchmarkIdSetLookupMap(b *testing.B)    { benchmarkIdSetLookup(b, "map") }
+func BenchmarkIdSetLookupSorted(b *testing.B) { benchmarkIdSetLookup(b, "sorted") }
+func BenchmarkIdSetLookupBitmap(b *testing.B) { benchmarkIdSetLookup(b, "bitmap") }
+func BenchmarkIdSetLookupMmap(b *testing.B)   { benchmarkIdSetLookup(b, "mmap") }
@@ -20,67 +20,93 @@ package main
 
 import (
 	"OSMPBF"
-	"code.google.com/p/goprotobuf/proto"
+	"context"
+	"errors"
 	"flag"
 	"io"
 	"math"
 	"os"
+	"pbf"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// preserveMetadata carries version, timestamp, changeset and user information
+// through to the output file.
+var preserveMetadata bool
+
 type boundingBoxUpdate struct {
 	wayIndex int
+	nodeId   int64
 	lon      float64
 	lat      float64
 }
 
-type node struct {
-	id     int64
-	lon    float64
-	lat    float64
-	keys   []string
-	values []string
-}
-
-type way struct {
-	id      int64
-	nodeIds []int64
-	keys    []string
-	values  []string
-}
-
-func supportedFilePass(file *os.File) {
-	for data := range MakePrimitiveBlockReader(file) {
-		if *data.blobHeader.Type == "OSMHeader" {
-			blockBytes, err := DecodeBlob(data)
+// supportedFilePass checks that every header in file can be read, and
+// returns the first one.
+func supportedFilePass(ctx context.Context, file *os.File) (*OSMPBF.HeaderBlock, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstHeader *OSMPBF.HeaderBlock
+	blocks, errs := pbf.MakePrimitiveBlockReader(ctx, io.NewSectionReader(file, 0, math.MaxInt64))
+	for data := range blocks {
+		if *data.BlobHeader.Type == "OSMHeader" {
+			header, err := pbf.DecodeHeader(data)
 			if err != nil {
-				println("OSMHeader blob read error:", err.Error())
-				os.Exit(5)
+				return nil, err
 			}
-
-			header := &OSMPBF.HeaderBlock{}
-			err = proto.Unmarshal(blockBytes, header)
-			if err != nil {
-				println("OSMHeader decode error:", err.Error())
-				os.Exit(5)
+			if firstHeader == nil {
+				firstHeader = header
 			}
+		}
+	}
+	return firstHeader, <-errs
+}
 
-			for _, feat := range header.RequiredFeatures {
-				if feat != "OsmSchema-V0.6" && feat != "DenseNodes" {
-					println("Unsupported feature required in OSM header:", feat)
-					os.Exit(5)
-				}
-			}
+// isSortedByTypeThenId tests whether a header declares that the file holds
+// its nodes, then its ways, then its relations, each in order of id.
+func isSortedByTypeThenId(header *OSMPBF.HeaderBlock) bool {
+	if header == nil {
+		return false
+	}
+	for _, feature := range header.OptionalFeatures {
+		if feature == "Sort.Type_then_ID" {
+			return true
 		}
 	}
+	return false
+}
+
+// lookupTags resolves string table indexes without copying the strings.
+func lookupTags(stringTable []string, keyIndexes []uint32, valueIndexes []uint32) ([]string, []string) {
+	keys := make([]string, len(keyIndexes))
+	vals := make([]string, len(keyIndexes))
+	for i, keyIndex := range keyIndexes {
+		keys[i] = stringTable[keyIndex]
+		vals[i] = stringTable[valueIndexes[i]]
+	}
+	return keys, vals
 }
 
-func findMatchingWaysPass(file *os.File, filterTag string, filterValue string, totalBlobCount int) [][]int64 {
+// findMatchingWaysPass finds the ways, relations and, if matchNodes is set,
+// nodes that match filter.  Given a nodeLocations store, it also records the
+// location of every node in the file there.
+func findMatchingWaysPass(ctx context.Context, file *os.File, filter tagFilter, matchNodes bool, nodeLocations nodeLocationStore, totalBlobCount int) ([][]int64, []pbf.Relation, []pbf.Node, error) {
 	wayNodeRefs := make([][]int64, 0, 100)
-	pending := make(chan bool)
+	relations := make([]pbf.Relation, 0, 100)
+	nodes := make([]pbf.Node, 0, 100)
 
 	appendNodeRefs := make(chan []int64)
 	appendNodeRefsComplete := make(chan bool)
+	appendRelation := make(chan pbf.Relation)
+	appendRelationComplete := make(chan bool)
+	appendNode := make(chan pbf.Node)
+	appendNodeComplete := make(chan bool)
 
 	go func() {
 		for nodeRefs := range appendNodeRefs {
@@ -89,65 +115,197 @@ func findMatchingWaysPass(file *os.File, filterTag string, filterValue string, t
 		appendNodeRefsComplete <- true
 	}()
 
-	blockDataReader := MakePrimitiveBlockReader(file)
-	for i := 0; i < runtime.NumCPU()*2; i++ {
-		go func() {
-			for data := range blockDataReader {
-				if *data.blobHeader.Type == "OSMData" {
-					blockBytes, err := DecodeBlob(data)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
-					}
+	go func() {
+		for relation := range appendRelation {
+			relations = append(relations, relation)
+		}
+		appendRelationComplete <- true
+	}()
 
-					primitiveBlock := &OSMPBF.PrimitiveBlock{}
-					err = proto.Unmarshal(blockBytes, primitiveBlock)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
+	go func() {
+		for node := range appendNode {
+			nodes = append(nodes, node)
+		}
+		appendNodeComplete <- true
+	}()
+
+	err := forEachPrimitiveBlock(ctx, file, totalBlobCount, func(primitiveBlock *OSMPBF.PrimitiveBlock) {
+		stringTable := make([]string, len(primitiveBlock.Stringtable.S))
+		for i, b := range primitiveBlock.Stringtable.S {
+			stringTable[i] = string(b)
+		}
+
+		if nodeLocations != nil {
+			for nodeAbs := range pbf.MakeNodeReader(primitiveBlock) {
+				lon, lat := nodeAbs.GetLonLat()
+				nodeLocations.set(nodeAbs.GetNodeId(), lon, lat)
+			}
+		}
+
+		if matchNodes {
+			for nodeAbs := range pbf.MakeNodeReader(primitiveBlock) {
+				keys, vals := nodeAbs.GetKeyValues()
+				if len(keys) == 0 || !filter.matches(keys, vals) {
+					continue
+				}
+				node := pbf.DecodeNode(nodeAbs)
+				if !preserveMetadata {
+					node.Info = nil
+				}
+				appendNode <- node
+			}
+		}
+
+		for _, primitiveGroup := range primitiveBlock.Primitivegroup {
+			for _, way := range primitiveGroup.Ways {
+				keys, vals := lookupTags(stringTable, way.Keys, way.Vals)
+				if filter.matches(keys, vals) {
+					var nodeRefs = make([]int64, len(way.Refs))
+					var prevNodeId int64 = 0
+					for index, deltaNodeId := range way.Refs {
+						nodeId := prevNodeId + deltaNodeId
+						prevNodeId = nodeId
+						nodeRefs[index] = nodeId
 					}
+					appendNodeRefs <- nodeRefs
+				}
+			}
 
-					for _, primitiveGroup := range primitiveBlock.Primitivegroup {
-						for _, way := range primitiveGroup.Ways {
-							for i, keyIndex := range way.Keys {
-								valueIndex := way.Vals[i]
-								key := string(primitiveBlock.Stringtable.S[keyIndex])
-								value := string(primitiveBlock.Stringtable.S[valueIndex])
-								if key == filterTag && value == filterValue {
-									var nodeRefs = make([]int64, len(way.Refs))
-									var prevNodeId int64 = 0
-									for index, deltaNodeId := range way.Refs {
-										nodeId := prevNodeId + deltaNodeId
-										prevNodeId = nodeId
-										nodeRefs[index] = nodeId
-									}
-									appendNodeRefs <- nodeRefs
-								}
-							}
-						}
+			for _, osmRelation := range primitiveGroup.Relations {
+				keys, vals := lookupTags(stringTable, osmRelation.Keys, osmRelation.Vals)
+				if filter.matches(keys, vals) {
+					relation := pbf.DecodeRelation(primitiveBlock, osmRelation)
+					if !preserveMetadata {
+						relation.Info = nil
 					}
+					appendRelation <- relation
 				}
+			}
+		}
+	})
+
+	close(appendNodeRefs)
+	<-appendNodeRefsComplete
+	close(appendNodeRefsComplete)
+	close(appendRelation)
+	<-appendRelationComplete
+	close(appendRelationComplete)
+	close(appendNode)
+	<-appendNodeComplete
+	close(appendNodeComplete)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return wayNodeRefs, relations, nodes, nil
+}
+
+func isMultipolygonRelation(relation pbf.Relation) bool {
+	for i, key := range relation.Keys {
+		if key == "type" && relation.Values[i] == "multipolygon" {
+			return true
+		}
+	}
+	return false
+}
 
-				pending <- true
+// findRelationMembersPass finds the node references of the outer ways of the
+// multipolygons among relations, and the relations that are members of any
+// of relations, other than those in knownRelations.  The member relations
+// found are added to knownRelations; their own members are found by another
+// pass.
+func findRelationMembersPass(ctx context.Context, file *os.File, relations []pbf.Relation, knownRelations map[int64]bool, totalBlobCount int) ([][]int64, []pbf.Relation, error) {
+	wayNodeRefs := make([][]int64, 0, 100)
+	memberRelations := make([]pbf.Relation, 0, 10)
+
+	// outer ways of multipolygons; old-style multipolygons leave the role empty
+	outerWaySet := make(map[int64]bool)
+	memberRelationSet := make(map[int64]bool)
+	for _, relation := range relations {
+		multipolygon := isMultipolygonRelation(relation)
+		for i, memberId := range relation.MemberIds {
+			role := relation.MemberRoles[i]
+			switch relation.MemberTypes[i] {
+			case OSMPBF.Relation_WAY:
+				if multipolygon && (role == "outer" || role == "") {
+					outerWaySet[memberId] = true
+				}
+			case OSMPBF.Relation_RELATION:
+				if !knownRelations[memberId] {
+					memberRelationSet[memberId] = true
+				}
 			}
-		}()
+		}
 	}
 
-	blobCount := 0
-	for _ = range pending {
-		blobCount += 1
-		if blobCount%500 == 0 {
-			println("\tComplete:", blobCount, "\tRemaining:", totalBlobCount-blobCount)
+	if len(outerWaySet) == 0 && len(memberRelationSet) == 0 {
+		return wayNodeRefs, memberRelations, nil
+	}
+
+	appendNodeRefs := make(chan []int64)
+	appendNodeRefsComplete := make(chan bool)
+	appendRelation := make(chan pbf.Relation)
+	appendRelationComplete := make(chan bool)
+
+	go func() {
+		for nodeRefs := range appendNodeRefs {
+			wayNodeRefs = append(wayNodeRefs, nodeRefs)
 		}
-		if blobCount == totalBlobCount {
-			close(pending)
-			close(appendNodeRefs)
-			<-appendNodeRefsComplete
-			close(appendNodeRefsComplete)
+		appendNodeRefsComplete <- true
+	}()
+
+	go func() {
+		for relation := range appendRelation {
+			memberRelations = append(memberRelations, relation)
 		}
+		appendRelationComplete <- true
+	}()
+
+	err := forEachPrimitiveBlock(ctx, file, totalBlobCount, func(primitiveBlock *OSMPBF.PrimitiveBlock) {
+		for _, primitiveGroup := range primitiveBlock.Primitivegroup {
+			for _, way := range primitiveGroup.Ways {
+				if !outerWaySet[*way.Id] {
+					continue
+				}
+				var nodeRefs = make([]int64, len(way.Refs))
+				var prevNodeId int64 = 0
+				for index, deltaNodeId := range way.Refs {
+					nodeId := prevNodeId + deltaNodeId
+					prevNodeId = nodeId
+					nodeRefs[index] = nodeId
+				}
+				appendNodeRefs <- nodeRefs
+			}
+
+			for _, osmRelation := range primitiveGroup.Relations {
+				if !memberRelationSet[*osmRelation.Id] {
+					continue
+				}
+				relation := pbf.DecodeRelation(primitiveBlock, osmRelation)
+				if !preserveMetadata {
+					relation.Info = nil
+				}
+				appendRelation <- relation
+			}
+		}
+	})
+
+	close(appendNodeRefs)
+	<-appendNodeRefsComplete
+	close(appendNodeRefsComplete)
+	close(appendRelation)
+	<-appendRelationComplete
+	close(appendRelationComplete)
+
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return wayNodeRefs
+	for _, relation := range memberRelations {
+		knownRelations[relation.Id] = true
+	}
+	return wayNodeRefs, memberRelations, nil
 }
 
 func isInBoundingBoxes(boundingBoxes [][]float64, lon float64, lat float64) bool {
@@ -162,26 +320,89 @@ func isInBoundingBoxes(boundingBoxes [][]float64, lon float64, lat float64) bool
 	return false
 }
 
-func calculateBoundingBoxesPass(file *os.File, wayNodeRefs [][]int64, totalBlobCount int) [][]float64 {
-	// maps node ids to wayNodeRef indexes
-	nodeOwners := make(map[int64][]int, len(wayNodeRefs)*4)
-	for wayIndex, way := range wayNodeRefs {
-		for _, nodeId := range way {
-			if nodeOwners[nodeId] == nil {
-				nodeOwners[nodeId] = make([]int, 0, 1)
-			}
-			nodeOwners[nodeId] = append(nodeOwners[nodeId], wayIndex)
+// metresPerDegree is the length of a degree of latitude on a spherical earth
+// with the mean radius of the WGS84 ellipsoid.
+const metresPerDegree = 6371008.8 * math.Pi / 180
+
+// expandBoundingBox grows a bounding box by the given distance on every side,
+// converting the distance to degrees of longitude at the box's latitude
+// furthest from the equator.  Latitudes stop at the poles, and a box that
+// grows across the antimeridian is wrapped around it, and so split in two.
+func expandBoundingBox(boundingBox []float64, metres float64) [][]float64 {
+	latDelta := metres / metresPerDegree
+	minLat := math.Max(boundingBox[1]-latDelta, -90)
+	maxLat := math.Min(boundingBox[3]+latDelta, 90)
+
+	cosLat := math.Cos(math.Max(math.Abs(minLat), math.Abs(maxLat)) * math.Pi / 180)
+	if cosLat <= 0 || latDelta/cosLat >= 180 {
+		// close enough to a pole that every longitude is within range
+		return [][]float64{{-180, minLat, 180, maxLat}}
+	}
+	lonDelta := latDelta / cosLat
+	minLon := boundingBox[0] - lonDelta
+	maxLon := boundingBox[2] + lonDelta
+
+	switch {
+	case maxLon-minLon >= 360:
+		return [][]float64{{-180, minLat, 180, maxLat}}
+	case minLon < -180:
+		return [][]float64{{-180, minLat, maxLon, maxLat}, {minLon + 360, minLat, 180, maxLat}}
+	case maxLon > 180:
+		return [][]float64{{minLon, minLat, 180, maxLat}, {-180, minLat, maxLon - 360, maxLat}}
+	}
+	return [][]float64{{minLon, minLat, maxLon, maxLat}}
+}
+
+// parseBoundingBox parses a bounding box given as minlon,minlat,maxlon,maxlat.
+func parseBoundingBox(value string) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, errors.New("expected minlon,minlat,maxlon,maxlat")
+	}
+
+	boundingBox := make([]float64, 4)
+	for i, part := range parts {
+		coordinate, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, errors.New("invalid coordinate " + part)
 		}
+		boundingBox[i] = coordinate
 	}
 
-	pending := make(chan bool)
+	if boundingBox[0] < -180 || boundingBox[2] > 180 || boundingBox[1] < -90 || boundingBox[3] > 90 {
+		return nil, errors.New("coordinates out of range")
+	}
+	if boundingBox[0] > boundingBox[2] || boundingBox[1] > boundingBox[3] {
+		return nil, errors.New("minimum coordinates exceed maximum coordinates")
+	}
+	return boundingBox, nil
+}
+
+// calculateBoundingBoxesPass calculates the bounding box of each way in
+// wayNodeRefs, and the location of each of their nodes if keepNodeLocations
+// is set.
+func calculateBoundingBoxesPass(ctx context.Context, file *os.File, wayNodeRefs [][]int64, keepNodeLocations bool, totalBlobCount int) ([][]float64, nodeLocationStore, error) {
+	nodeOwners := newWayNodeIndex(wayNodeRefs)
+
 	updateWayBoundingBoxes := make(chan boundingBoxUpdate)
 	updateWayBoundingBoxesComplete := make(chan bool)
 
 	wayBoundingBoxes := make([][]float64, len(wayNodeRefs))
+	var nodeLocations nodeLocationStore
+	if keepNodeLocations {
+		var err error
+		nodeLocations, err = newNodeLocationStore(nodeOwners.Len())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
 	go func() {
 		for update := range updateWayBoundingBoxes {
+			if nodeLocations != nil {
+				nodeLocations.set(update.nodeId, update.lon, update.lat)
+			}
+
 			boundingBox := wayBoundingBoxes[update.wayIndex]
 			if boundingBox == nil {
 				boundingBox = make([]float64, 4)
@@ -200,64 +421,65 @@ func calculateBoundingBoxesPass(file *os.File, wayNodeRefs [][]int64, totalBlobC
 		updateWayBoundingBoxesComplete <- true
 	}()
 
-	blockDataReader := MakePrimitiveBlockReader(file)
-	for i := 0; i < runtime.NumCPU()*2; i++ {
-		go func() {
-			for data := range blockDataReader {
-				if *data.blobHeader.Type == "OSMData" {
-					blockBytes, err := DecodeBlob(data)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
-					}
-
-					primitiveBlock := &OSMPBF.PrimitiveBlock{}
-					err = proto.Unmarshal(blockBytes, primitiveBlock)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
-					}
+	err := forEachPrimitiveBlock(ctx, file, totalBlobCount, func(primitiveBlock *OSMPBF.PrimitiveBlock) {
+		for node := range pbf.MakeNodeReader(primitiveBlock) {
+			owners := nodeOwners.owners(node.GetNodeId())
+			if len(owners) == 0 {
+				continue
+			}
+			lon, lat := node.GetLonLat()
+			for _, wayIndex := range owners {
+				updateWayBoundingBoxes <- boundingBoxUpdate{int(wayIndex), node.GetNodeId(), lon, lat}
+			}
 
-					for node := range MakeNodeReader(primitiveBlock) {
-						owners := nodeOwners[node.GetNodeId()]
-						if owners == nil {
-							continue
-						}
-						lon, lat := node.GetLonLat()
-						for _, wayIndex := range owners {
-							updateWayBoundingBoxes <- boundingBoxUpdate{wayIndex, lon, lat}
-						}
+		}
+	})
 
-					}
-				}
+	close(updateWayBoundingBoxes)
+	<-updateWayBoundingBoxesComplete
+	close(updateWayBoundingBoxesComplete)
 
-				pending <- true
-			}
-		}()
+	if err != nil {
+		if nodeLocations != nil {
+			nodeLocations.close()
+		}
+		return nil, nil, err
 	}
 
-	blobCount := 0
-	for _ = range pending {
-		blobCount += 1
-		if blobCount%500 == 0 {
-			println("\tComplete:", blobCount, "\tRemaining:", totalBlobCount-blobCount)
-		}
-		if blobCount == totalBlobCount {
-			close(pending)
-			close(updateWayBoundingBoxes)
-			<-updateWayBoundingBoxesComplete
-			close(updateWayBoundingBoxesComplete)
+	return wayBoundingBoxes, nodeLocations, nil
+}
+
+// calculateBoundingBoxes does the work of calculateBoundingBoxesPass from
+// node locations that were stored while reading the file for pass 2.
+func calculateBoundingBoxes(wayNodeRefs [][]int64, nodeLocations nodeLocationStore) [][]float64 {
+	wayBoundingBoxes := make([][]float64, len(wayNodeRefs))
+	for wayIndex, nodeIds := range wayNodeRefs {
+		var boundingBox []float64
+		for _, nodeId := range nodeIds {
+			lon, lat, ok := nodeLocations.get(nodeId)
+			if !ok {
+				continue
+			}
+			if boundingBox == nil {
+				boundingBox = []float64{lon, lat, lon, lat}
+			} else {
+				boundingBox[0] = math.Min(boundingBox[0], lon)
+				boundingBox[1] = math.Min(boundingBox[1], lat)
+				boundingBox[2] = math.Max(boundingBox[2], lon)
+				boundingBox[3] = math.Max(boundingBox[3], lat)
+			}
 		}
+		wayBoundingBoxes[wayIndex] = boundingBox
 	}
-
 	return wayBoundingBoxes
 }
 
-func findNodesWithinBoundingBoxesPass(file *os.File, boundingBoxes [][]float64, totalBlobCount int) []node {
-	retvalNodes := make([]node, 0, 100000)
-	pending := make(chan bool)
+// findNodesWithinBoundingBoxesPass finds the nodes that are within any of the
+// bounding boxes or polygons.
+func findNodesWithinBoundingBoxesPass(ctx context.Context, file *os.File, boundingBoxes [][]float64, polygons []polygon, totalBlobCount int) ([]pbf.Node, error) {
+	retvalNodes := make([]pbf.Node, 0, 100000)
 
-	appendNode := make(chan node)
+	appendNode := make(chan pbf.Node)
 	appendNodeComplete := make(chan bool)
 
 	go func() {
@@ -267,72 +489,147 @@ func findNodesWithinBoundingBoxesPass(file *os.File, boundingBoxes [][]float64,
 		appendNodeComplete <- true
 	}()
 
-	blockDataReader := MakePrimitiveBlockReader(file)
-	for i := 0; i < runtime.NumCPU()*2; i++ {
-		go func() {
-			for data := range blockDataReader {
-				if *data.blobHeader.Type == "OSMData" {
-					blockBytes, err := DecodeBlob(data)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
-					}
-
-					primitiveBlock := &OSMPBF.PrimitiveBlock{}
-					err = proto.Unmarshal(blockBytes, primitiveBlock)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
-					}
+	index := newAreaIndex(boundingBoxes, polygons)
 
-					for nodeAbs := range MakeNodeReader(primitiveBlock) {
-						lon, lat := nodeAbs.GetLonLat()
-						if isInBoundingBoxes(boundingBoxes, lon, lat) {
-							keys, vals := nodeAbs.GetKeyValues()
-							node := node{
-								nodeAbs.GetNodeId(),
-								lon,
-								lat,
-								keys,
-								vals,
-							}
-							appendNode <- node
-						}
-					}
+	err := forEachPrimitiveBlock(ctx, file, totalBlobCount, func(primitiveBlock *OSMPBF.PrimitiveBlock) {
+		for nodeAbs := range pbf.MakeNodeReader(primitiveBlock) {
+			lon, lat := nodeAbs.GetLonLat()
+			if index.contains(lon, lat) {
+				node := pbf.DecodeNode(nodeAbs)
+				if !preserveMetadata {
+					node.Info = nil
 				}
+				appendNode <- node
+			}
+		}
+	})
+
+	close(appendNode)
+	<-appendNodeComplete
+	close(appendNodeComplete)
 
-				pending <- true
+	if err != nil {
+		return nil, err
+	}
+
+	return retvalNodes, nil
+}
+
+func relationMemberWaySet(relations []pbf.Relation) map[int64]bool {
+	memberWaySet := make(map[int64]bool)
+	for _, relation := range relations {
+		for i, memberId := range relation.MemberIds {
+			if relation.MemberTypes[i] == OSMPBF.Relation_WAY {
+				memberWaySet[memberId] = true
 			}
-		}()
+		}
 	}
+	return memberWaySet
+}
 
-	blobCount := 0
-	for _ = range pending {
-		blobCount += 1
-		if blobCount%500 == 0 {
-			println("\tComplete:", blobCount, "\tRemaining:", totalBlobCount-blobCount)
+func wayUsesNodes(osmWay *OSMPBF.Way, nodeSet idSet) bool {
+	var prevNodeId int64 = 0
+	for _, deltaNodeId := range osmWay.Refs {
+		nodeId := prevNodeId + deltaNodeId
+		prevNodeId = nodeId
+		if nodeSet.contains(nodeId) {
+			return true
+		}
+	}
+	return false
+}
+
+// findNodesAndWaysWithinBoundingBoxesPass does the work of passes 5 and 6 in
+// a single pass over a file sorted by type then id, in which every node is
+// seen before the ways that use it.  It returns errUnsortedInput for a file
+// that turns out not to be sorted.
+func findNodesAndWaysWithinBoundingBoxesPass(ctx context.Context, file *os.File, boundingBoxes [][]float64, polygons []polygon, relations []pbf.Relation, totalBlobCount int) ([]pbf.Node, []pbf.Way, error) {
+	nodes := make([]pbf.Node, 0, 100000)
+	ways := make([]pbf.Way, 0, 1000)
+
+	index := newAreaIndex(boundingBoxes, polygons)
+	memberWaySet := relationMemberWaySet(relations)
+	nodeSet, err := newIdSet(100000)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer nodeSet.close()
+
+	// nodes and ways are appended by the worker goroutines, as the barrier
+	// between the two stages leaves no room for collector goroutines
+	var lock sync.Mutex
+	waysStarted := false
+
+	err = forEachSortedPrimitiveBlock(ctx, file, totalBlobCount, func(primitiveBlock *OSMPBF.PrimitiveBlock) {
+		blockNodes := make([]pbf.Node, 0)
+		for nodeAbs := range pbf.MakeNodeReader(primitiveBlock) {
+			lon, lat := nodeAbs.GetLonLat()
+			if index.contains(lon, lat) {
+				node := pbf.DecodeNode(nodeAbs)
+				if !preserveMetadata {
+					node.Info = nil
+				}
+				blockNodes = append(blockNodes, node)
+			}
 		}
-		if blobCount == totalBlobCount {
-			close(pending)
-			close(appendNode)
-			<-appendNodeComplete
-			close(appendNodeComplete)
+		if len(blockNodes) == 0 {
+			return
 		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if waysStarted {
+			// ways that came before these nodes have already been checked, and
+			// forEachSortedPrimitiveBlock will report the file as unsorted
+			return
+		}
+		for _, node := range blockNodes {
+			nodeSet.add(node.Id)
+		}
+		nodes = append(nodes, blockNodes...)
+	}, func(primitiveBlock *OSMPBF.PrimitiveBlock) {
+		lock.Lock()
+		waysStarted = true
+		lock.Unlock()
+
+		for _, primitiveGroup := range primitiveBlock.Primitivegroup {
+			for _, osmWay := range primitiveGroup.Ways {
+				if memberWaySet[*osmWay.Id] || wayUsesNodes(osmWay, nodeSet) {
+					way := pbf.DecodeWay(primitiveBlock, osmWay)
+					if !preserveMetadata {
+						way.Info = nil
+					}
+					lock.Lock()
+					ways = append(ways, way)
+					lock.Unlock()
+				}
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return retvalNodes
+	return nodes, ways, nil
 }
 
-func findWaysUsingNodesPass(file *os.File, nodes []node, totalBlobCount int) []way {
-	ways := make([]way, 0, 1000)
-	pending := make(chan bool)
+func findWaysUsingNodesPass(ctx context.Context, file *os.File, nodes []pbf.Node, relations []pbf.Relation, totalBlobCount int) ([]pbf.Way, error) {
+	ways := make([]pbf.Way, 0, 1000)
 
-	nodeSet := make(map[int64]bool, len(nodes))
+	nodeSet, err := newIdSet(len(nodes))
+	if err != nil {
+		return nil, err
+	}
+	defer nodeSet.close()
 	for _, node := range nodes {
-		nodeSet[node.id] = true
+		nodeSet.add(node.Id)
 	}
 
-	appendWay := make(chan way)
+	// ways that are members of matching relations are always included
+	memberWaySet := relationMemberWaySet(relations)
+
+	appendWay := make(chan pbf.Way)
 	appendWayComplete := make(chan bool)
 
 	go func() {
@@ -342,176 +639,375 @@ func findWaysUsingNodesPass(file *os.File, nodes []node, totalBlobCount int) []w
 		appendWayComplete <- true
 	}()
 
-	blockDataReader := MakePrimitiveBlockReader(file)
-	for i := 0; i < runtime.NumCPU()*2; i++ {
-		go func() {
-			for data := range blockDataReader {
-				if *data.blobHeader.Type == "OSMData" {
-					blockBytes, err := DecodeBlob(data)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
-					}
-
-					primitiveBlock := &OSMPBF.PrimitiveBlock{}
-					err = proto.Unmarshal(blockBytes, primitiveBlock)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
-					}
+	err = forEachPrimitiveBlock(ctx, file, totalBlobCount, func(primitiveBlock *OSMPBF.PrimitiveBlock) {
+		for _, primitiveGroup := range primitiveBlock.Primitivegroup {
+			for _, osmWay := range primitiveGroup.Ways {
 
-					for _, primitiveGroup := range primitiveBlock.Primitivegroup {
-						for _, osmWay := range primitiveGroup.Ways {
-
-							match := false
-
-							var prevNodeId int64 = 0
-							for _, deltaNodeId := range osmWay.Refs {
-								nodeId := prevNodeId + deltaNodeId
-								prevNodeId = nodeId
-
-								if nodeSet[nodeId] {
-									match = true
-									break
-								}
-							}
-
-							if match {
-								nodeRefs := make([]int64, len(osmWay.Refs))
-								prevNodeId = 0
-								for index, deltaNodeId := range osmWay.Refs {
-									nodeId := prevNodeId + deltaNodeId
-									prevNodeId = nodeId
-									nodeRefs[index] = nodeId
-								}
-
-								keys := make([]string, len(osmWay.Keys))
-								vals := make([]string, len(osmWay.Keys))
-								for i, keyIndex := range osmWay.Keys {
-									valueIndex := osmWay.Vals[i]
-									keys[i] = string(primitiveBlock.Stringtable.S[keyIndex])
-									vals[i] = string(primitiveBlock.Stringtable.S[valueIndex])
-								}
-
-								appendWay <- way{
-									*osmWay.Id,
-									nodeRefs,
-									keys,
-									vals,
-								}
-							}
-						}
+				if memberWaySet[*osmWay.Id] || wayUsesNodes(osmWay, nodeSet) {
+					way := pbf.DecodeWay(primitiveBlock, osmWay)
+					if !preserveMetadata {
+						way.Info = nil
 					}
+					appendWay <- way
 				}
-
-				pending <- true
 			}
-		}()
-	}
-
-	blobCount := 0
-	for _ = range pending {
-		blobCount += 1
-		if blobCount%500 == 0 {
-			println("\tComplete:", blobCount, "\tRemaining:", totalBlobCount-blobCount)
 		}
-		if blobCount == totalBlobCount {
-			close(pending)
-			close(appendWay)
-			<-appendWayComplete
-			close(appendWayComplete)
-		}
-	}
+	})
 
-	return ways
-}
+	close(appendWay)
+	<-appendWayComplete
+	close(appendWayComplete)
 
-func findNodesReferencedByWaysPass(file *os.File, ways []way, nodes []node, totalBlobCount int) []node {
-	pending := make(chan bool)
+	if err != nil {
+		return nil, err
+	}
 
-	const NODE_REFERENCED = 1
-	const NODE_STORED = 2
+	return ways, nil
+}
 
-	nodeSet := make(map[int64]int, len(nodes))
+func findNodesReferencedByWaysPass(ctx context.Context, file *os.File, ways []pbf.Way, relations []pbf.Relation, nodes []pbf.Node, totalBlobCount int) ([]pbf.Node, error) {
+	referencedCount := 0
+	for _, way := range ways {
+		referencedCount += len(way.NodeIds)
+	}
 
+	referencedSet, err := newIdSet(referencedCount)
+	if err != nil {
+		return nil, err
+	}
+	defer referencedSet.close()
 	for _, way := range ways {
-		for _, nodeId := range way.nodeIds {
-			nodeSet[nodeId] = NODE_REFERENCED
+		for _, nodeId := range way.NodeIds {
+			referencedSet.add(nodeId)
 		}
 	}
 
+	for _, relation := range relations {
+		for i, memberId := range relation.MemberIds {
+			if relation.MemberTypes[i] == OSMPBF.Relation_NODE {
+				referencedSet.add(memberId)
+			}
+		}
+	}
+
+	storedSet, err := newIdSet(len(nodes))
+	if err != nil {
+		return nil, err
+	}
+	defer storedSet.close()
 	for _, node := range nodes {
-		nodeSet[node.id] = NODE_STORED
+		storedSet.add(node.Id)
 	}
 
-	appendNode := make(chan node)
+	appendNode := make(chan pbf.Node)
 	appendNodeComplete := make(chan bool)
 
 	go func() {
 		for node := range appendNode {
-			nodeSet[node.id] = NODE_STORED
 			nodes = append(nodes, node)
 		}
 		appendNodeComplete <- true
 	}()
 
-	blockDataReader := MakePrimitiveBlockReader(file)
-	for i := 0; i < runtime.NumCPU()*2; i++ {
-		go func() {
-			for data := range blockDataReader {
-				if *data.blobHeader.Type == "OSMData" {
-					blockBytes, err := DecodeBlob(data)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
-					}
+	err = forEachPrimitiveBlock(ctx, file, totalBlobCount, func(primitiveBlock *OSMPBF.PrimitiveBlock) {
+		for nodeAbs := range pbf.MakeNodeReader(primitiveBlock) {
+			nodeId := nodeAbs.GetNodeId()
+			if referencedSet.contains(nodeId) && !storedSet.contains(nodeId) {
+				node := pbf.DecodeNode(nodeAbs)
+				if !preserveMetadata {
+					node.Info = nil
+				}
+				appendNode <- node
+			}
+		}
+	})
 
-					primitiveBlock := &OSMPBF.PrimitiveBlock{}
-					err = proto.Unmarshal(blockBytes, primitiveBlock)
-					if err != nil {
-						println("OSMData decode error:", err.Error())
-						os.Exit(6)
-					}
+	close(appendNode)
+	<-appendNodeComplete
+	close(appendNodeComplete)
 
-					for nodeAbs := range MakeNodeReader(primitiveBlock) {
-						if nodeSet[nodeAbs.GetNodeId()] == NODE_REFERENCED {
-							lon, lat := nodeAbs.GetLonLat()
-							keys, vals := nodeAbs.GetKeyValues()
-							node := node{
-								nodeAbs.GetNodeId(),
-								lon,
-								lat,
-								keys,
-								vals,
-							}
-							appendNode <- node
-						}
-					}
-				}
+	if err != nil {
+		return nil, err
+	}
 
-				pending <- true
-			}
-		}()
+	return nodes, nil
+}
+
+// sortNodes, sortWays and sortRelations sort entities by id, keeping any that
+// share an id in their original order.
+func sortNodes(nodes []pbf.Node) {
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+}
+
+func sortWays(ways []pbf.Way) {
+	sort.SliceStable(ways, func(i, j int) bool { return ways[i].Id < ways[j].Id })
+}
+
+func sortRelations(relations []pbf.Relation) {
+	sort.SliceStable(relations, func(i, j int) bool { return relations[i].Id < relations[j].Id })
+}
+
+// uniqueNodes sorts nodes by id, dropping all but the first of any that
+// share an id.
+func uniqueNodes(nodes []pbf.Node) []pbf.Node {
+	sortNodes(nodes)
+
+	unique := 0
+	for i, node := range nodes {
+		if i == 0 || node.Id != nodes[unique-1].Id {
+			nodes[unique] = node
+			unique += 1
+		}
+	}
+	return nodes[:unique]
+}
+
+// uniqueWays sorts ways by id, dropping all but the first of any that share an
+// id.
+func uniqueWays(ways []pbf.Way) []pbf.Way {
+	sortWays(ways)
+
+	unique := 0
+	for i, way := range ways {
+		if i == 0 || way.Id != ways[unique-1].Id {
+			ways[unique] = way
+			unique += 1
+		}
+	}
+	return ways[:unique]
+}
+
+// uniqueRelations sorts relations by id, dropping all but the first of any
+// that share an id.
+func uniqueRelations(relations []pbf.Relation) []pbf.Relation {
+	sortRelations(relations)
+
+	unique := 0
+	for i, relation := range relations {
+		if i == 0 || relation.Id != relations[unique-1].Id {
+			relations[unique] = relation
+			unique += 1
+		}
+	}
+	return relations[:unique]
+}
+
+// uniqueEntities sorts the nodes, ways and relations by id, dropping all but
+// the first of any that share an id with another of their type, and returns
+// them with the number dropped.
+func uniqueEntities(nodes []pbf.Node, ways []pbf.Way, relations []pbf.Relation) ([]pbf.Node, []pbf.Way, []pbf.Relation, int) {
+	entityCount := len(nodes) + len(ways) + len(relations)
+	nodes = uniqueNodes(nodes)
+	ways = uniqueWays(ways)
+	relations = uniqueRelations(relations)
+	return nodes, ways, relations, entityCount - len(nodes) - len(ways) - len(relations)
+}
+
+// rawCoordinate converts degrees to the default granularity of 100 nanodegrees.
+func rawCoordinate(degrees float64) int64 {
+	return int64(math.Floor(degrees*10000000 + 0.5))
+}
+
+// encodeInfo converts metadata for output; blocks are written with the default
+// date_granularity of 1000 milliseconds.
+func encodeInfo(info *pbf.Info, stringTableIndexes map[string]uint32) *OSMPBF.Info {
+	if info == nil {
+		return nil
+	}
+
+	version := info.Version
+	timestamp := info.Timestamp / 1000
+	changeset := info.Changeset
+	uid := info.Uid
+	userSid := stringTableIndexes[info.User]
+	return &OSMPBF.Info{
+		Version:   &version,
+		Timestamp: &timestamp,
+		Changeset: &changeset,
+		Uid:       &uid,
+		UserSid:   &userSid,
+	}
+}
+
+func encodeSparseNodes(nodeGroup []pbf.Node, stringTableIndexes map[string]uint32) []*OSMPBF.Node {
+	osmNodes := make([]*OSMPBF.Node, len(nodeGroup))
+
+	for idx, node := range nodeGroup {
+		osmNode := &OSMPBF.Node{}
+
+		var nodeId int64 = node.Id
+		osmNode.Id = &nodeId
+
+		var rawlon int64 = rawCoordinate(node.Lon)
+		var rawlat int64 = rawCoordinate(node.Lat)
+		osmNode.Lon = &rawlon
+		osmNode.Lat = &rawlat
+
+		osmNode.Keys = make([]uint32, len(node.Keys))
+		for i, s := range node.Keys {
+			osmNode.Keys[i] = stringTableIndexes[s]
+		}
+		osmNode.Vals = make([]uint32, len(node.Values))
+		for i, s := range node.Values {
+			osmNode.Vals[i] = stringTableIndexes[s]
+		}
+		osmNode.Info = encodeInfo(node.Info, stringTableIndexes)
+		osmNodes[idx] = osmNode
+	}
+
+	return osmNodes
+}
+
+// encodeDenseNodes encodes a group of nodes that either all have metadata, or
+// have none; denseinfo cannot leave out the metadata of some of its nodes.
+func encodeDenseNodes(nodeGroup []pbf.Node, stringTableIndexes map[string]uint32) *OSMPBF.DenseNodes {
+	dense := &OSMPBF.DenseNodes{}
+	dense.Id = make([]int64, len(nodeGroup))
+	dense.Lon = make([]int64, len(nodeGroup))
+	dense.Lat = make([]int64, len(nodeGroup))
+
+	// keys_vals and denseinfo are left out entirely when no node in the group
+	// needs them
+	hasTags := false
+	hasInfo := len(nodeGroup) != 0
+	for _, node := range nodeGroup {
+		hasTags = hasTags || len(node.Keys) != 0
+		hasInfo = hasInfo && node.Info != nil
+	}
+
+	if hasTags {
+		dense.KeysVals = make([]int32, 0, len(nodeGroup)*3)
+	}
+
+	var denseInfo *OSMPBF.DenseInfo
+	if hasInfo {
+		denseInfo = &OSMPBF.DenseInfo{}
+		denseInfo.Version = make([]int32, len(nodeGroup))
+		denseInfo.Timestamp = make([]int64, len(nodeGroup))
+		denseInfo.Changeset = make([]int64, len(nodeGroup))
+		denseInfo.Uid = make([]int32, len(nodeGroup))
+		denseInfo.UserSid = make([]int32, len(nodeGroup))
+		dense.Denseinfo = denseInfo
 	}
 
-	blobCount := 0
-	for _ = range pending {
-		blobCount += 1
-		if blobCount%500 == 0 {
-			println("\tComplete:", blobCount, "\tRemaining:", totalBlobCount-blobCount)
+	// delta-encode everything but the version and keys_vals
+	var prevNodeId int64 = 0
+	var prevLon int64 = 0
+	var prevLat int64 = 0
+	var prevTimestamp int64 = 0
+	var prevChangeset int64 = 0
+	var prevUid int32 = 0
+	var prevUserSid int32 = 0
+
+	for idx, node := range nodeGroup {
+		rawlon := rawCoordinate(node.Lon)
+		rawlat := rawCoordinate(node.Lat)
+		dense.Id[idx] = node.Id - prevNodeId
+		dense.Lon[idx] = rawlon - prevLon
+		dense.Lat[idx] = rawlat - prevLat
+		prevNodeId = node.Id
+		prevLon = rawlon
+		prevLat = rawlat
+
+		if hasTags {
+			for i, s := range node.Keys {
+				dense.KeysVals = append(dense.KeysVals, int32(stringTableIndexes[s]), int32(stringTableIndexes[node.Values[i]]))
+			}
+			dense.KeysVals = append(dense.KeysVals, 0)
 		}
-		if blobCount == totalBlobCount {
-			close(pending)
-			close(appendNode)
-			<-appendNodeComplete
-			close(appendNodeComplete)
+
+		if hasInfo {
+			timestamp := node.Info.Timestamp / 1000
+			userSid := int32(stringTableIndexes[node.Info.User])
+			denseInfo.Version[idx] = node.Info.Version
+			denseInfo.Timestamp[idx] = timestamp - prevTimestamp
+			denseInfo.Changeset[idx] = node.Info.Changeset - prevChangeset
+			denseInfo.Uid[idx] = node.Info.Uid - prevUid
+			denseInfo.UserSid[idx] = userSid - prevUserSid
+			prevTimestamp = timestamp
+			prevChangeset = node.Info.Changeset
+			prevUid = node.Info.Uid
+			prevUserSid = userSid
 		}
 	}
 
+	return dense
+}
+
+// hasMixedInfo reports whether some, but not all, of nodes have metadata.
+func hasMixedInfo(nodes []pbf.Node) bool {
+	withInfo := 0
+	for _, node := range nodes {
+		if node.Info != nil {
+			withInfo++
+		}
+	}
+	return withInfo != 0 && withInfo != len(nodes)
+}
+
+// appendMissingNodes appends the extra nodes that are not already in nodes.
+func appendMissingNodes(nodes []pbf.Node, extraNodes []pbf.Node) []pbf.Node {
+	nodeSet := make(map[int64]bool, len(nodes))
+	for _, node := range nodes {
+		nodeSet[node.Id] = true
+	}
+	for _, node := range extraNodes {
+		if !nodeSet[node.Id] {
+			nodeSet[node.Id] = true
+			nodes = append(nodes, node)
+		}
+	}
 	return nodes
 }
 
-func writeNodes(file *os.File, nodes []node) error {
+// makeOutputHeader carries the source, replication details and optional
+// features of the input header over to the output, leaving out the features
+// that no longer hold.  The output's bounding box is the extracted
+// boundingBox, given with -bbox, or else the box around the output nodes.
+func makeOutputHeader(inputHeader *OSMPBF.HeaderBlock, nodes []pbf.Node, boundingBox []float64) *OSMPBF.HeaderBlock {
+	header := &OSMPBF.HeaderBlock{}
+	if inputHeader != nil {
+		header.Source = inputHeader.Source
+		header.OsmosisReplicationTimestamp = inputHeader.OsmosisReplicationTimestamp
+		header.OsmosisReplicationSequenceNumber = inputHeader.OsmosisReplicationSequenceNumber
+		header.OsmosisReplicationBaseUrl = inputHeader.OsmosisReplicationBaseUrl
+
+		for _, feature := range inputHeader.OptionalFeatures {
+			// the output is sorted by type then id, and has no way locations
+			if feature == "Sort.Geographic" || feature == "LocationsOnWays" || (feature == "Has_Metadata" && !preserveMetadata) {
+				continue
+			}
+			header.OptionalFeatures = append(header.OptionalFeatures, feature)
+		}
+	}
+
+	if boundingBox == nil && len(nodes) > 0 {
+		boundingBox = []float64{nodes[0].Lon, nodes[0].Lat, nodes[0].Lon, nodes[0].Lat}
+		for _, node := range nodes {
+			boundingBox[0] = math.Min(boundingBox[0], node.Lon)
+			boundingBox[1] = math.Min(boundingBox[1], node.Lat)
+			boundingBox[2] = math.Max(boundingBox[2], node.Lon)
+			boundingBox[3] = math.Max(boundingBox[3], node.Lat)
+		}
+	}
+
+	if boundingBox != nil {
+		// header bounding boxes are always in nanodegrees; round outwards
+		left := int64(math.Floor(boundingBox[0] * 1e9))
+		right := int64(math.Ceil(boundingBox[2] * 1e9))
+		top := int64(math.Ceil(boundingBox[3] * 1e9))
+		bottom := int64(math.Floor(boundingBox[1] * 1e9))
+		header.Bbox = &OSMPBF.HeaderBBox{Left: &left, Right: &right, Top: &top, Bottom: &bottom}
+	}
+
+	return header
+}
+
+// writeNodes writes nodes, which must be sorted by id as declared in the
+// output header, in blocks of 8000.  A block of dense nodes in which only some of the
+// nodes have metadata is written as sparse nodes instead, so that the
+// metadata of each node is kept exactly.
+func writeNodes(writer *blockWriter, nodes []pbf.Node, denseNodes bool) error {
 	if len(nodes) == 0 {
 		return nil
 	}
@@ -528,53 +1024,41 @@ func writeNodes(file *os.File, nodes []node) error {
 		stringTableIndexes := make(map[string]uint32, 0)
 
 		for _, node := range nodeGroup {
-			for _, s := range node.keys {
+			for _, s := range node.Keys {
 				idx := stringTableIndexes[s]
 				if idx == 0 {
 					stringTableIndexes[s] = uint32(len(stringTable))
 					stringTable = append(stringTable, []byte(s))
 				}
 			}
-			for _, s := range node.values {
+			for _, s := range node.Values {
 				idx := stringTableIndexes[s]
 				if idx == 0 {
 					stringTableIndexes[s] = uint32(len(stringTable))
 					stringTable = append(stringTable, []byte(s))
 				}
 			}
-		}
-
-		osmNodes := make([]*OSMPBF.Node, len(nodeGroup))
-
-		for idx, node := range nodeGroup {
-			osmNode := &OSMPBF.Node{}
-
-			var nodeId int64 = node.id
-			osmNode.Id = &nodeId
-
-			var rawlon int64 = int64(node.lon/.000000001) / 100
-			var rawlat int64 = int64(node.lat/.000000001) / 100
-			osmNode.Lon = &rawlon
-			osmNode.Lat = &rawlat
-
-			osmNode.Keys = make([]uint32, len(node.keys))
-			for i, s := range node.keys {
-				osmNode.Keys[i] = stringTableIndexes[s]
-			}
-			osmNode.Vals = make([]uint32, len(node.values))
-			for i, s := range node.values {
-				osmNode.Vals[i] = stringTableIndexes[s]
+			if node.Info != nil {
+				s := node.Info.User
+				idx := stringTableIndexes[s]
+				if idx == 0 {
+					stringTableIndexes[s] = uint32(len(stringTable))
+					stringTable = append(stringTable, []byte(s))
+				}
 			}
-			osmNodes[idx] = osmNode
 		}
 
 		group := OSMPBF.PrimitiveGroup{}
-		group.Nodes = osmNodes
+		if denseNodes && !hasMixedInfo(nodeGroup) {
+			group.Dense = encodeDenseNodes(nodeGroup, stringTableIndexes)
+		} else {
+			group.Nodes = encodeSparseNodes(nodeGroup, stringTableIndexes)
+		}
 
 		block := OSMPBF.PrimitiveBlock{}
 		block.Stringtable = &OSMPBF.StringTable{stringTable, nil}
 		block.Primitivegroup = []*OSMPBF.PrimitiveGroup{&group}
-		err := WriteBlock(file, &block, "OSMData")
+		err := writer.write(&block, "OSMData")
 		if err != nil {
 			return err
 		}
@@ -583,7 +1067,9 @@ func writeNodes(file *os.File, nodes []node) error {
 	return nil
 }
 
-func writeWays(file *os.File, ways []way) error {
+// writeWays writes ways, which must be sorted by id as declared in the output
+// header, in blocks of 8000.
+func writeWays(writer *blockWriter, ways []pbf.Way) error {
 	if len(ways) == 0 {
 		return nil
 	}
@@ -600,14 +1086,22 @@ func writeWays(file *os.File, ways []way) error {
 		stringTableIndexes := make(map[string]uint32, 0)
 
 		for _, way := range wayGroup {
-			for _, s := range way.keys {
+			for _, s := range way.Keys {
+				idx := stringTableIndexes[s]
+				if idx == 0 {
+					stringTableIndexes[s] = uint32(len(stringTable))
+					stringTable = append(stringTable, []byte(s))
+				}
+			}
+			for _, s := range way.Values {
 				idx := stringTableIndexes[s]
 				if idx == 0 {
 					stringTableIndexes[s] = uint32(len(stringTable))
 					stringTable = append(stringTable, []byte(s))
 				}
 			}
-			for _, s := range way.values {
+			if way.Info != nil {
+				s := way.Info.User
 				idx := stringTableIndexes[s]
 				if idx == 0 {
 					stringTableIndexes[s] = uint32(len(stringTable))
@@ -621,27 +1115,28 @@ func writeWays(file *os.File, ways []way) error {
 		for idx, way := range wayGroup {
 			osmWay := &OSMPBF.Way{}
 
-			var wayId int64 = way.id
+			var wayId int64 = way.Id
 			osmWay.Id = &wayId
 
 			// delta-encode the node ids
-			nodeRefs := make([]int64, len(way.nodeIds))
+			nodeRefs := make([]int64, len(way.NodeIds))
 			var prevNodeId int64 = 0
-			for i, nodeId := range way.nodeIds {
+			for i, nodeId := range way.NodeIds {
 				nodeIdDelta := nodeId - prevNodeId
 				prevNodeId = nodeId
 				nodeRefs[i] = nodeIdDelta
 			}
 			osmWay.Refs = nodeRefs
 
-			osmWay.Keys = make([]uint32, len(way.keys))
-			for i, s := range way.keys {
+			osmWay.Keys = make([]uint32, len(way.Keys))
+			for i, s := range way.Keys {
 				osmWay.Keys[i] = stringTableIndexes[s]
 			}
-			osmWay.Vals = make([]uint32, len(way.values))
-			for i, s := range way.values {
+			osmWay.Vals = make([]uint32, len(way.Values))
+			for i, s := range way.Values {
 				osmWay.Vals[i] = stringTableIndexes[s]
 			}
+			osmWay.Info = encodeInfo(way.Info, stringTableIndexes)
 			osmWays[idx] = osmWay
 		}
 
@@ -651,7 +1146,108 @@ func writeWays(file *os.File, ways []way) error {
 		block := OSMPBF.PrimitiveBlock{}
 		block.Stringtable = &OSMPBF.StringTable{stringTable, nil}
 		block.Primitivegroup = []*OSMPBF.PrimitiveGroup{&group}
-		err := WriteBlock(file, &block, "OSMData")
+		err := writer.write(&block, "OSMData")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeRelations writes relations, which must be sorted by id as declared in
+// the output header, in blocks of 8000.
+func writeRelations(writer *blockWriter, relations []pbf.Relation) error {
+	if len(relations) == 0 {
+		return nil
+	}
+
+	for relationGroupIndex := 0; relationGroupIndex < (len(relations)/8000)+1; relationGroupIndex++ {
+		beg := (relationGroupIndex + 0) * 8000
+		end := (relationGroupIndex + 1) * 8000
+		if len(relations) < end {
+			end = len(relations)
+		}
+		relationGroup := relations[beg:end]
+
+		stringTable := make([][]byte, 1, 1000)
+		stringTableIndexes := make(map[string]uint32, 0)
+
+		for _, relation := range relationGroup {
+			for _, s := range relation.Keys {
+				idx := stringTableIndexes[s]
+				if idx == 0 {
+					stringTableIndexes[s] = uint32(len(stringTable))
+					stringTable = append(stringTable, []byte(s))
+				}
+			}
+			for _, s := range relation.Values {
+				idx := stringTableIndexes[s]
+				if idx == 0 {
+					stringTableIndexes[s] = uint32(len(stringTable))
+					stringTable = append(stringTable, []byte(s))
+				}
+			}
+			if relation.Info != nil {
+				s := relation.Info.User
+				idx := stringTableIndexes[s]
+				if idx == 0 {
+					stringTableIndexes[s] = uint32(len(stringTable))
+					stringTable = append(stringTable, []byte(s))
+				}
+			}
+			for _, s := range relation.MemberRoles {
+				idx := stringTableIndexes[s]
+				if idx == 0 {
+					stringTableIndexes[s] = uint32(len(stringTable))
+					stringTable = append(stringTable, []byte(s))
+				}
+			}
+		}
+
+		osmRelations := make([]*OSMPBF.Relation, len(relationGroup))
+
+		for idx, relation := range relationGroup {
+			osmRelation := &OSMPBF.Relation{}
+
+			var relationId int64 = relation.Id
+			osmRelation.Id = &relationId
+
+			// delta-encode the member ids
+			memberIds := make([]int64, len(relation.MemberIds))
+			var prevMemberId int64 = 0
+			for i, memberId := range relation.MemberIds {
+				memberIdDelta := memberId - prevMemberId
+				prevMemberId = memberId
+				memberIds[i] = memberIdDelta
+			}
+			osmRelation.Memids = memberIds
+			osmRelation.Types = relation.MemberTypes
+
+			osmRelation.RolesSid = make([]int32, len(relation.MemberRoles))
+			for i, s := range relation.MemberRoles {
+				osmRelation.RolesSid[i] = int32(stringTableIndexes[s])
+			}
+
+			osmRelation.Keys = make([]uint32, len(relation.Keys))
+			for i, s := range relation.Keys {
+				osmRelation.Keys[i] = stringTableIndexes[s]
+			}
+			osmRelation.Vals = make([]uint32, len(relation.Values))
+			for i, s := range relation.Values {
+				osmRelation.Vals[i] = stringTableIndexes[s]
+			}
+			osmRelation.Info = encodeInfo(relation.Info, stringTableIndexes)
+			osmRelations[idx] = osmRelation
+		}
+
+		group := OSMPBF.PrimitiveGroup{}
+		group.Relations = osmRelations
+
+		block := OSMPBF.PrimitiveBlock{}
+		block.Stringtable = &OSMPBF.StringTable{S: stringTable}
+		block.Primitivegroup = []*OSMPBF.PrimitiveGroup{&group}
+		err := writer.write(&block, "OSMData")
 		if err != nil {
 			return err
 		}
@@ -660,6 +1256,32 @@ func writeWays(file *os.File, ways []way) error {
 	return nil
 }
 
+// exitOnReadError reports an error reading the input file and exits, with an
+// exit status that depends upon the kind of error.  A pass that cannot make
+// its memory-mapped stores is reported as such, as it is not the input's
+// fault.
+func exitOnReadError(err error) {
+	if err == nil {
+		return
+	}
+
+	if _, ok := err.(*storeError); ok {
+		println("Memory-mapped store error:", err.Error())
+		os.Exit(4)
+	}
+
+	println("Input file read error:", err.Error())
+	switch err.(type) {
+	case *pbf.CorruptHeaderError:
+		os.Exit(2)
+	case *pbf.TruncatedBlobError:
+		os.Exit(3)
+	case *pbf.UnsupportedFeatureError:
+		os.Exit(5)
+	}
+	os.Exit(6)
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU() * 2)
 
@@ -668,8 +1290,106 @@ func main() {
 	highMemory := flag.Bool("high-memory", false, "use higher amounts of memory for higher performance")
 	filterTag := flag.String("t", "leisure", "tag to filter ways based upon")
 	filterValue := flag.String("v", "golf_course", "value to ensure that the way's tag is set to")
+	nodeSeeds := flag.String("node-seeds", "", "also match nodes; \"output\" writes matching nodes, \"area\" extracts the area around them")
+	nodeRadius := flag.Float64("node-radius", 100, "radius in metres of the area around matching nodes for -node-seeds=area")
+	filterExpression := flag.String("f", "", "tag filter expression, eg. \"leisure=golf_course or sport=baseball\"; overrides -t and -v.  Quote a regexp containing spaces or any of =!~,() as in name~'^(Old|New) Course$'")
+	flag.BoolVar(&preserveMetadata, "metadata", false, "preserve version, timestamp, changeset and user metadata")
+	outputFormat := flag.String("format", "pbf", "output format: pbf, or osm for OSM XML")
+	sparseNodes := flag.Bool("sparse-nodes", false, "write nodes without DenseNodes encoding")
+	compression := flag.String("compression", "zlib", "output blob compression: none, zlib[:level], zstd[:level] or lzma")
+	source := flag.String("source", "", "source written to the output header; defaults to the input header's")
+	replicationTimestamp := flag.String("replication-timestamp", "", "replication timestamp written to the output header, eg. 2012-10-01T12:00:00Z; defaults to the input header's")
+	replicationSequence := flag.Int64("replication-sequence", -1, "replication sequence number written to the output header; defaults to the input header's")
+	boundingBoxOption := flag.String("bbox", "", "extract the area minlon,minlat,maxlon,maxlat instead of matching tags")
+	clipGeometry := flag.Bool("clip-geometry", false, "extract the area within matching closed ways rather than their bounding boxes")
+	buffer := flag.Float64("buffer", 0, "distance in metres around matching ways to include")
+	flag.StringVar(&idSetKind, "id-set", "map", "node id set implementation: map, sorted, bitmap or mmap")
+	flag.StringVar(&nodeLocationKind, "node-locations", "map", "node location store: map, or mmap to keep every node's location while reading pass 2 and skip reading the file for pass 4")
+	flag.StringVar(&storeDirectory, "store-dir", "", "directory for the files of -id-set=mmap and -node-locations=mmap; defaults to the system temporary directory")
+	polygonFile := flag.String("poly", "", "extract the area of an Osmosis .poly or GeoJSON polygon file instead of matching tags")
+	replicationUrl := flag.String("replication-url", "", "replication base URL written to the output header; defaults to the input header's")
 	flag.Parse()
 
+	var err error
+	outputCompression, err = parseBlobCompression(*compression)
+	if err != nil {
+		println("Compression option error:", err.Error())
+		os.Exit(1)
+	}
+
+	var replicationTime time.Time
+	if *replicationTimestamp != "" {
+		replicationTime, err = time.Parse(time.RFC3339, *replicationTimestamp)
+		if err != nil {
+			println("Replication timestamp error:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var filter tagFilter
+	if *filterExpression != "" {
+		filter, err = parseTagFilter(*filterExpression)
+		if err != nil {
+			println("Filter expression error:", err.Error())
+			os.Exit(1)
+		}
+	} else {
+		filter = newTagEqualsFilter(*filterTag, *filterValue)
+	}
+
+	if *outputFormat != "pbf" && *outputFormat != "osm" {
+		println("Unknown -format:", *outputFormat)
+		os.Exit(1)
+	}
+
+	if *nodeSeeds != "" && *nodeSeeds != "output" && *nodeSeeds != "area" {
+		println("Unknown -node-seeds mode:", *nodeSeeds)
+		os.Exit(1)
+	}
+
+	err = checkIdSetKind(idSetKind)
+	if err != nil {
+		println("-id-set error:", err.Error())
+		os.Exit(1)
+	}
+	if nodeLocationKind != "map" && nodeLocationKind != "mmap" {
+		println("Unknown -node-locations store:", nodeLocationKind)
+		os.Exit(1)
+	}
+
+	var extractBoundingBox []float64
+	if *boundingBoxOption != "" {
+		extractBoundingBox, err = parseBoundingBox(*boundingBoxOption)
+		if err != nil {
+			println("Bounding box error:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var extractPolygons []polygon
+	if *polygonFile != "" {
+		extractPolygons, err = readPolygonFile(*polygonFile)
+		if err != nil {
+			println("Polygon file error:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if extractBoundingBox != nil && extractPolygons != nil {
+		println("-bbox and -poly cannot be used together")
+		os.Exit(1)
+	}
+	if (extractBoundingBox != nil || extractPolygons != nil) && (*nodeSeeds != "" || *clipGeometry || *buffer != 0) {
+		println("-node-seeds, -clip-geometry and -buffer cannot be used with -bbox or -poly")
+		os.Exit(1)
+	}
+	if *buffer < 0 {
+		println("-buffer cannot be negative")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
 	file, err := os.Open(*inputFile)
 	if err != nil {
 		println("Unable to open file:", err.Error())
@@ -679,7 +1399,7 @@ func main() {
 	// Count the total number of blobs; provides a nice progress indicator
 	totalBlobCount := 0
 	for {
-		blobHeader, err := ReadNextBlobHeader(file)
+		blobHeader, err := pbf.ReadNextBlobHeader(file)
 		if err == io.EOF {
 			break
 		} else if err != nil {
@@ -696,29 +1416,131 @@ func main() {
 		cacheUncompressedBlobs = make(map[int64][]byte, totalBlobCount)
 	}
 
-	println("Pass 1/6: Find OSMHeaders")
-	supportedFilePass(file)
-	println("Pass 1/6: Complete")
+	println("Pass 1/7: Find OSMHeaders")
+	inputHeader, err := supportedFilePass(ctx, file)
+	exitOnReadError(err)
+	println("Pass 1/7: Complete")
+
+	var relations []pbf.Relation
+	var seedNodes []pbf.Node
+	var boundingBoxes [][]float64
+	if extractBoundingBox != nil {
+		println("Pass 2/7: Skipped; extracting the -bbox area")
+		println("Pass 3/7: Skipped; extracting the -bbox area")
+		println("Pass 4/7: Skipped; extracting the -bbox area")
+		boundingBoxes = [][]float64{extractBoundingBox}
+	} else if extractPolygons != nil {
+		println("Pass 2/7: Skipped; extracting the -poly area")
+		println("Pass 3/7: Skipped; extracting the -poly area")
+		println("Pass 4/7: Skipped; extracting the -poly area")
+	} else {
+		// with a memory-mapped store, the location of every node can be kept
+		// while reading pass 2, and pass 4 needs no pass over the file
+		var nodeLocations nodeLocationStore
+		if nodeLocationKind == "mmap" {
+			nodeLocations, err = newNodeLocationStore(0)
+			if err != nil {
+				println("Memory-mapped store error:", err.Error())
+				os.Exit(4)
+			}
+		}
 
-	println("Pass 2/6: Find node references of matching areas")
-	wayNodeRefs := findMatchingWaysPass(file, *filterTag, *filterValue, totalBlobCount)
-	println("Pass 2/6: Complete;", len(wayNodeRefs), "matching ways found.")
+		var wayNodeRefs [][]int64
+		println("Pass 2/7: Find node references of matching areas")
+		wayNodeRefs, relations, seedNodes, err = findMatchingWaysPass(ctx, file, filter, *nodeSeeds != "", nodeLocations, totalBlobCount)
+		exitOnReadError(err)
+		println("Pass 2/7: Complete;", len(wayNodeRefs), "matching ways,", len(relations), "matching relations and", len(seedNodes), "matching nodes found.")
+
+		// the member relations of matching relations are written too, and their
+		// own members are found in turn, so that the output is complete
+		knownRelations := make(map[int64]bool, len(relations))
+		for _, relation := range relations {
+			knownRelations[relation.Id] = true
+		}
+		for pendingRelations := relations; len(pendingRelations) > 0; {
+			println("Pass 3/7: Find node references of multipolygon outer ways, and member relations")
+			outerWayNodeRefs, memberRelations, err := findRelationMembersPass(ctx, file, pendingRelations, knownRelations, totalBlobCount)
+			exitOnReadError(err)
+			wayNodeRefs = append(wayNodeRefs, outerWayNodeRefs...)
+			relations = append(relations, memberRelations...)
+			pendingRelations = memberRelations
+			println("Pass 3/7: Complete;", len(outerWayNodeRefs), "multipolygon outer ways and", len(memberRelations), "member relations found.")
+		}
+
+		if nodeLocations != nil {
+			println("Pass 4/7: Establish bounding boxes from the node locations of pass 2")
+			boundingBoxes = calculateBoundingBoxes(wayNodeRefs, nodeLocations)
+		} else {
+			println("Pass 4/7: Establish bounding boxes")
+			boundingBoxes, nodeLocations, err = calculateBoundingBoxesPass(ctx, file, wayNodeRefs, *clipGeometry, totalBlobCount)
+			exitOnReadError(err)
+		}
+		println("Pass 4/7: Complete;", len(boundingBoxes), "bounding boxes calculated.")
 
-	println("Pass 3/6: Establish bounding boxes")
-	boundingBoxes := calculateBoundingBoxesPass(file, wayNodeRefs, totalBlobCount)
-	println("Pass 3/6: Complete;", len(boundingBoxes), "bounding boxes calculated.")
+		if *clipGeometry {
+			extractPolygons, boundingBoxes = closedWayPolygons(wayNodeRefs, boundingBoxes, nodeLocations, *buffer)
+			println("Pass 4/7:", len(extractPolygons), "closed ways used as polygons.")
+		}
+		if nodeLocations != nil {
+			nodeLocations.close()
+		}
+
+		if *buffer > 0 {
+			bufferedBoxes := make([][]float64, 0, len(boundingBoxes))
+			for _, boundingBox := range boundingBoxes {
+				if boundingBox != nil {
+					bufferedBoxes = append(bufferedBoxes, expandBoundingBox(boundingBox, *buffer)...)
+				}
+			}
+			boundingBoxes = bufferedBoxes
+		}
+
+		if *nodeSeeds == "area" {
+			for _, node := range seedNodes {
+				boundingBoxes = append(boundingBoxes, expandBoundingBox([]float64{node.Lon, node.Lat, node.Lon, node.Lat}, *nodeRadius)...)
+			}
+		}
+	}
+
+	var nodes []pbf.Node
+	var ways []pbf.Way
+	sortedInput := isSortedByTypeThenId(inputHeader)
+	if sortedInput {
+		// every node comes before the ways using it, so one pass will do
+		println("Pass 5-6/7: Find nodes within bounding boxes, and ways using them or in relations (sorted input)")
+		nodes, ways, err = findNodesAndWaysWithinBoundingBoxesPass(ctx, file, boundingBoxes, extractPolygons, relations, totalBlobCount)
+		if err == errUnsortedInput {
+			println("Pass 5-6/7:", err.Error()+"; making passes 5 and 6 separately")
+			sortedInput = false
+		} else {
+			exitOnReadError(err)
+			println("Pass 5-6/7: Complete;", len(nodes), "nodes and", len(ways), "ways located.")
+		}
+	}
+	if !sortedInput {
+		println("Pass 5/7: Find nodes within bounding boxes")
+		nodes, err = findNodesWithinBoundingBoxesPass(ctx, file, boundingBoxes, extractPolygons, totalBlobCount)
+		exitOnReadError(err)
+		println("Pass 5/7: Complete;", len(nodes), "nodes located.")
+
+		println("Pass 6/7: Find ways using intersecting nodes and relation member ways")
+		ways, err = findWaysUsingNodesPass(ctx, file, nodes, relations, totalBlobCount)
+		exitOnReadError(err)
+		println("Pass 6/7: Complete;", len(ways), "ways located.")
+	}
 
-	println("Pass 4/6: Find nodes within bounding boxes")
-	nodes := findNodesWithinBoundingBoxesPass(file, boundingBoxes, totalBlobCount)
-	println("Pass 4/6: Complete;", len(nodes), "nodes located.")
+	println("Pass 7/7: Find nodes referenced by intersected ways and relations")
+	nodes, err = findNodesReferencedByWaysPass(ctx, file, ways, relations, nodes, totalBlobCount)
+	exitOnReadError(err)
+	println("Pass 7/7: Complete;", len(nodes), "total nodes (pass 5 + pass 7) located.")
 
-	println("Pass 5/6: Find ways using intersecting nodes")
-	ways := findWaysUsingNodesPass(file, nodes, totalBlobCount)
-	println("Pass 5/6: Complete;", len(ways), "ways located.")
+	if *nodeSeeds == "output" {
+		nodes = appendMissingNodes(nodes, seedNodes)
+	}
 
-	println("Pass 6/6: Find nodes referenced by intersected ways")
-	nodes = findNodesReferencedByWaysPass(file, ways, nodes, totalBlobCount)
-	println("Pass 6/6: Complete;", len(nodes), "total nodes (pass 4 + pass 6) located.")
+	// an input with repeated ids yields their entities more than once, and
+	// each is written only once, in order of id as the writers expect
+	nodes, ways, relations, duplicateCount := uniqueEntities(nodes, ways, relations)
 
 	output, err := os.OpenFile(*outputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
 	if err != nil {
@@ -726,22 +1548,69 @@ func main() {
 		os.Exit(2)
 	}
 
-	println("Out 1/3: Writing header")
-	err = WriteHeader(output)
+	header := makeOutputHeader(inputHeader, nodes, extractBoundingBox)
+	if *source != "" {
+		header.Source = source
+	}
+	if *replicationTimestamp != "" {
+		seconds := replicationTime.Unix()
+		header.OsmosisReplicationTimestamp = &seconds
+	}
+	if *replicationSequence >= 0 {
+		header.OsmosisReplicationSequenceNumber = replicationSequence
+	}
+	if *replicationUrl != "" {
+		header.OsmosisReplicationBaseUrl = replicationUrl
+	}
+
+	if *outputFormat == "osm" {
+		println("Out 1/1: Writing OSM XML")
+		err = writeOsmXml(output, header, nodes, ways, relations)
+		if err != nil {
+			println("Output file write error:", err.Error())
+			os.Exit(2)
+		}
+
+		err = output.Close()
+		if err != nil {
+			println("Output file write error:", err.Error())
+			os.Exit(2)
+		}
+		println("Output:", len(nodes), "nodes,", len(ways), "ways and", len(relations), "relations;", duplicateCount, "duplicates dropped.")
+		return
+	}
+
+	println("Out 1/4: Writing header")
+	err = WriteHeader(output, header, !*sparseNodes)
+	if err != nil {
+		println("Output file write error:", err.Error())
+		os.Exit(2)
+	}
+
+	writer := newBlockWriter(output)
+
+	println("Out 2/4: Writing nodes")
+	err = writeNodes(writer, nodes, !*sparseNodes)
+	if err != nil {
+		println("Output file write error:", err.Error())
+		os.Exit(2)
+	}
+
+	println("Out 3/4: Writing ways")
+	err = writeWays(writer, ways)
 	if err != nil {
 		println("Output file write error:", err.Error())
 		os.Exit(2)
 	}
 
-	println("Out 2/3: Writing nodes")
-	err = writeNodes(output, nodes)
+	println("Out 4/4: Writing relations")
+	err = writeRelations(writer, relations)
 	if err != nil {
 		println("Output file write error:", err.Error())
 		os.Exit(2)
 	}
 
-	println("Out 3/3: Writing ways")
-	err = writeWays(output, ways)
+	err = writer.close()
 	if err != nil {
 		println("Output file write error:", err.Error())
 		os.Exit(2)
@@ -752,4 +1621,5 @@ func main() {
 		println("Output file write error:", err.Error())
 		os.Exit(2)
 	}
+	println("Output:", len(nodes), "nodes,", len(ways), "ways and", len(relations), "relations;", duplicateCount, "duplicates dropped.")
 }
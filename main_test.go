@@ -0,0 +1,340 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"OSMPBF"
+	"context"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"pbf"
+	"reflect"
+	"testing"
+)
+
+// newRoundTripFixture makes entities in descending order of id, with tags and
+// metadata on every one of them, and enough nodes to fill two blocks.
+func newRoundTripFixture() *passFixture {
+	fixture := &passFixture{}
+	for i := 8100; i > 0; i-- {
+		node := pbf.Node{
+			Id:   int64(i) * 3,
+			Lon:  -179.9999999 + float64(i)*0.0001234,
+			Lat:  89.9999999 - float64(i)*0.0004321,
+			Info: &pbf.Info{Version: int32(i % 7), Timestamp: 1349090000000 + int64(i)*1000, Changeset: int64(i / 10), Uid: int32(i % 13), User: "user" + string(rune('a'+i%5))},
+		}
+		if i%3 == 0 {
+			node.Keys = []string{"amenity", "name"}
+			node.Values = []string{"bench", "Bank <" + string(rune('a'+i%26)) + ">"}
+		}
+		fixture.nodes = append(fixture.nodes, node)
+	}
+
+	for i := 20; i > 0; i-- {
+		fixture.ways = append(fixture.ways, pbf.Way{
+			Id:      int64(i),
+			NodeIds: []int64{int64(i) * 3, int64(i)*3 + 6, int64(i) * 3},
+			Keys:    []string{"leisure"},
+			Values:  []string{"golf_course"},
+			Info:    &pbf.Info{Version: 1, Timestamp: 1349090000000, Changeset: 5, Uid: 3, User: "carol"},
+		})
+	}
+
+	fixture.relations = append(fixture.relations, pbf.Relation{
+		Id:          2,
+		MemberIds:   []int64{3, 1, 9},
+		MemberTypes: []OSMPBF.Relation_MemberType{OSMPBF.Relation_WAY, OSMPBF.Relation_WAY, OSMPBF.Relation_NODE},
+		MemberRoles: []string{"outer", "inner", ""},
+		Keys:        []string{"type", "leisure"},
+		Values:      []string{"multipolygon", "golf_course"},
+		Info:        &pbf.Info{Version: 2, Timestamp: 1349090001000, Changeset: 6, Uid: 3, User: "carol"},
+	}, pbf.Relation{
+		Id:          1,
+		MemberIds:   []int64{2},
+		MemberTypes: []OSMPBF.Relation_MemberType{OSMPBF.Relation_RELATION},
+		MemberRoles: []string{"subarea"},
+		Keys:        []string{"type"},
+		Values:      []string{"collection"},
+	})
+
+	return fixture
+}
+
+// readFile reads every entity of a PBF file.
+func readFile(t *testing.T, file *os.File) (*OSMPBF.HeaderBlock, *passFixture) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := &passFixture{}
+	reader := pbf.NewReader(context.Background(), file)
+	defer reader.Close()
+	for {
+		entity, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		switch entity := entity.(type) {
+		case *pbf.Node:
+			fixture.nodes = append(fixture.nodes, *entity)
+		case *pbf.Way:
+			fixture.ways = append(fixture.ways, *entity)
+		case *pbf.Relation:
+			fixture.relations = append(fixture.relations, *entity)
+		}
+	}
+	return reader.Header(), fixture
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		denseNodes  bool
+		compression string
+	}{
+		{"dense nodes, zlib", true, "zlib"},
+		{"sparse nodes, zlib", false, "zlib:9"},
+		{"dense nodes, uncompressed", true, "none"},
+		{"sparse nodes, zstd", false, "zstd"},
+		{"dense nodes, lzma", true, "lzma"},
+	}
+
+	for _, test := range tests {
+		fixture := newRoundTripFixture()
+		fixture.nodes, fixture.ways, fixture.relations, _ = uniqueEntities(fixture.nodes, fixture.ways, fixture.relations)
+		expected := newRoundTripFixture()
+		sortNodes(expected.nodes)
+		sortWays(expected.ways)
+		sortRelations(expected.relations)
+
+		header, written := readFile(t, fixture.writeFormattedFile(t, test.denseNodes, test.compression, true))
+
+		if !isSortedByTypeThenId(header) {
+			t.Errorf("%s: header does not declare Sort.Type_then_ID", test.name)
+		}
+		if test.denseNodes != reflect.DeepEqual(header.RequiredFeatures, []string{"OsmSchema-V0.6", "DenseNodes"}) {
+			t.Errorf("%s: header requires %v", test.name, header.RequiredFeatures)
+		}
+
+		if len(written.nodes) != len(expected.nodes) {
+			t.Fatalf("%s: %d nodes written, expected %d", test.name, len(written.nodes), len(expected.nodes))
+		}
+		for i, node := range written.nodes {
+			want := expected.nodes[i]
+			if node.Id != want.Id || math.Abs(node.Lon-want.Lon) > 1e-9 || math.Abs(node.Lat-want.Lat) > 1e-9 {
+				t.Fatalf("%s: node %d at %v, %v, expected %d at %v, %v", test.name, node.Id, node.Lon, node.Lat, want.Id, want.Lon, want.Lat)
+			}
+			// every third node is tagged, and the rest have no tags at all
+			i := node.Id / 3
+			if i%3 == 0 {
+				if !reflect.DeepEqual(node.Keys, []string{"amenity", "name"}) || !reflect.DeepEqual(node.Values, []string{"bench", "Bank <" + string(rune('a'+i%26)) + ">"}) {
+					t.Fatalf("%s: node %d tagged %v=%v", test.name, node.Id, node.Keys, node.Values)
+				}
+			} else if len(node.Keys) != 0 || len(node.Values) != 0 {
+				t.Fatalf("%s: node %d tagged %v=%v, expected no tags", test.name, node.Id, node.Keys, node.Values)
+			}
+			if !reflect.DeepEqual(node.Info, want.Info) {
+				t.Fatalf("%s: node %d has info %+v, expected %+v", test.name, node.Id, node.Info, want.Info)
+			}
+		}
+
+		if !reflect.DeepEqual(written.ways, expected.ways) {
+			t.Errorf("%s: ways %+v, expected %+v", test.name, written.ways, expected.ways)
+		}
+		if !reflect.DeepEqual(written.relations, expected.relations) {
+			t.Errorf("%s: relations %+v, expected %+v", test.name, written.relations, expected.relations)
+		}
+	}
+}
+
+func TestUniqueEntities(t *testing.T) {
+	// the first of each id is tagged, to tell it from those dropped
+	first := []string{"first"}
+	tests := []struct {
+		name           string
+		nodes          []pbf.Node
+		ways           []pbf.Way
+		relations      []pbf.Relation
+		nodeIds        []int64
+		wayIds         []int64
+		relationIds    []int64
+		duplicateCount int
+	}{
+		{"empty", nil, nil, nil, []int64{}, []int64{}, []int64{}, 0},
+		{
+			"unique",
+			[]pbf.Node{{Id: 3, Keys: first}, {Id: 1, Keys: first}, {Id: 2, Keys: first}},
+			[]pbf.Way{{Id: 2, Keys: first}, {Id: 1, Keys: first}},
+			[]pbf.Relation{{Id: 1, Keys: first}},
+			[]int64{1, 2, 3}, []int64{1, 2}, []int64{1}, 0,
+		},
+		{
+			"repeated",
+			[]pbf.Node{{Id: 5, Keys: first}, {Id: 2, Keys: first}, {Id: 5}, {Id: 5}, {Id: 2}},
+			[]pbf.Way{{Id: 4, Keys: first}, {Id: 4}},
+			[]pbf.Relation{{Id: 9, Keys: first}, {Id: 8, Keys: first}, {Id: 9}},
+			[]int64{2, 5}, []int64{4}, []int64{8, 9}, 5,
+		},
+		{
+			"shared across types",
+			[]pbf.Node{{Id: 1, Keys: first}},
+			[]pbf.Way{{Id: 1, Keys: first}},
+			[]pbf.Relation{{Id: 1, Keys: first}},
+			[]int64{1}, []int64{1}, []int64{1}, 0,
+		},
+	}
+
+	for _, test := range tests {
+		nodes, ways, relations, duplicateCount := uniqueEntities(test.nodes, test.ways, test.relations)
+		if duplicateCount != test.duplicateCount {
+			t.Errorf("%s: %d duplicates dropped, expected %d", test.name, duplicateCount, test.duplicateCount)
+		}
+		ids := []int64{}
+		for _, node := range nodes {
+			ids = append(ids, node.Id)
+			if !reflect.DeepEqual(node.Keys, first) {
+				t.Errorf("%s: node %d is not the first with its id", test.name, node.Id)
+			}
+		}
+		checkIds(t, test.name+" nodes", ids, test.nodeIds)
+		ids = []int64{}
+		for _, way := range ways {
+			ids = append(ids, way.Id)
+			if !reflect.DeepEqual(way.Keys, first) {
+				t.Errorf("%s: way %d is not the first with its id", test.name, way.Id)
+			}
+		}
+		checkIds(t, test.name+" ways", ids, test.wayIds)
+		ids = []int64{}
+		for _, relation := range relations {
+			ids = append(ids, relation.Id)
+			if !reflect.DeepEqual(relation.Keys, first) {
+				t.Errorf("%s: relation %d is not the first with its id", test.name, relation.Id)
+			}
+		}
+		checkIds(t, test.name+" relations", ids, test.relationIds)
+	}
+}
+
+func TestWriteMixedMetadata(t *testing.T) {
+	for _, denseNodes := range []bool{true, false} {
+		fixture := &passFixture{}
+		for i := 1; i <= 20; i++ {
+			node := pbf.Node{Id: int64(i), Lon: float64(i) * 0.5, Lat: float64(i) * -0.25}
+			if i%3 != 0 {
+				node.Info = &pbf.Info{Version: int32(i), Timestamp: 1349090000000 + int64(i)*1000, Changeset: int64(i) * 2, Uid: int32(i % 4), User: "user" + string(rune('a'+i%4))}
+			}
+			fixture.nodes = append(fixture.nodes, node)
+		}
+
+		_, written := readFile(t, fixture.writeFormattedFile(t, denseNodes, "zlib", true))
+		if len(written.nodes) != len(fixture.nodes) {
+			t.Fatalf("dense nodes %v: %d nodes written, expected %d", denseNodes, len(written.nodes), len(fixture.nodes))
+		}
+		for i, node := range written.nodes {
+			want := fixture.nodes[i]
+			if node.Id != want.Id || !reflect.DeepEqual(node.Info, want.Info) {
+				t.Errorf("dense nodes %v: node %d has info %+v, expected node %d with %+v", denseNodes, node.Id, node.Info, want.Id, want.Info)
+			}
+		}
+	}
+}
+
+func TestMakeOutputHeader(t *testing.T) {
+	defer func(previous bool) { preserveMetadata = previous }(preserveMetadata)
+
+	inputHeader := &OSMPBF.HeaderBlock{OptionalFeatures: []string{"Has_Metadata", "Sort.Geographic", "LocationsOnWays", "timestamp=2012-10-01T00:00:00Z"}}
+	nodes := []pbf.Node{{Id: 1, Lon: -1.5, Lat: 51.25}, {Id: 2, Lon: 2.5, Lat: 50.75}}
+	tests := []struct {
+		name        string
+		metadata    bool
+		boundingBox []float64
+		features    []string
+		bbox        [4]int64
+	}{
+		{"without metadata", false, nil, []string{"timestamp=2012-10-01T00:00:00Z"}, [4]int64{-1500000000, 50750000000, 2500000000, 51250000000}},
+		{"with metadata", true, nil, []string{"Has_Metadata", "timestamp=2012-10-01T00:00:00Z"}, [4]int64{-1500000000, 50750000000, 2500000000, 51250000000}},
+		{"with -bbox", false, []float64{-2, 50, 3, 52}, []string{"timestamp=2012-10-01T00:00:00Z"}, [4]int64{-2000000000, 50000000000, 3000000000, 52000000000}},
+	}
+
+	for _, test := range tests {
+		preserveMetadata = test.metadata
+		header := makeOutputHeader(inputHeader, nodes, test.boundingBox)
+		if !reflect.DeepEqual(header.OptionalFeatures, test.features) {
+			t.Errorf("%s: optional features %v, expected %v", test.name, header.OptionalFeatures, test.features)
+		}
+		bbox := [4]int64{*header.Bbox.Left, *header.Bbox.Bottom, *header.Bbox.Right, *header.Bbox.Top}
+		if bbox != test.bbox {
+			t.Errorf("%s: bbox %v, expected %v", test.name, bbox, test.bbox)
+		}
+
+		output, err := os.Create(filepath.Join(t.TempDir(), "header.osm.pbf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = WriteHeader(output, header, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written, _ := readFile(t, output)
+		output.Close()
+		features := append(test.features, "Sort.Type_then_ID")
+		if !reflect.DeepEqual(written.OptionalFeatures, features) {
+			t.Errorf("%s: written optional features %v, expected %v", test.name, written.OptionalFeatures, features)
+		}
+	}
+}
+
+func TestExpandBoundingBox(t *testing.T) {
+	// 1000 metres is 0.0089932 degrees of latitude, and of longitude at the
+	// equator
+	tests := []struct {
+		name        string
+		boundingBox []float64
+		metres      float64
+		expected    [][]float64
+	}{
+		{"equator", []float64{10, 0, 10.5, 0}, 1000, [][]float64{{9.9910068, -0.0089932, 10.5089932, 0.0089932}}},
+		{"high latitude", []float64{10, 70, 10, 70}, 1000, [][]float64{{9.9736943, 69.9910068, 10.0263057, 70.0089932}}},
+		{"southern high latitude", []float64{10, -70, 10, -70}, 1000, [][]float64{{9.9736943, -70.0089932, 10.0263057, -69.9910068}}},
+		{"pole", []float64{10, 89.995, 10, 89.995}, 1000, [][]float64{{-180, 89.9860068, 180, 90}}},
+		{"east of the antimeridian", []float64{179.995, 0, 179.995, 0}, 1000, [][]float64{{179.9860068, -0.0089932, 180, 0.0089932}, {-180, -0.0089932, -179.9960068, 0.0089932}}},
+		{"west of the antimeridian", []float64{-179.995, 0, -179.995, 0}, 1000, [][]float64{{-180, -0.0089932, -179.9860068, 0.0089932}, {179.9960068, -0.0089932, 180, 0.0089932}}},
+		{"every longitude", []float64{-179.995, 0, 179.995, 0}, 1000, [][]float64{{-180, -0.0089932, 180, 0.0089932}}},
+		{"no distance", []float64{1, 2, 3, 4}, 0, [][]float64{{1, 2, 3, 4}}},
+	}
+
+	for _, test := range tests {
+		expanded := expandBoundingBox(test.boundingBox, test.metres)
+		matches := len(expanded) == len(test.expected)
+		for i := 0; matches && i < len(expanded); i++ {
+			for j := range expanded[i] {
+				matches = matches && math.Abs(expanded[i][j]-test.expected[i][j]) < 1e-7
+			}
+		}
+		if !matches {
+			t.Errorf("%s: %v, expected %v", test.name, expanded, test.expected)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+)
+
+// storeDirectory holds the files behind memory-mapped stores; empty for the
+// system's temporary directory.
+var storeDirectory string
+
+// mappedStoreIds is the number of ids that the arrays of the mapped stores
+// can grow to cover, comfortably beyond the largest OSM node ids.  Larger and
+// negative ids are kept in a map instead.
+const mappedStoreIds = 1 << 34
+
+// mappedFileInitialSize is the size in bytes of a new mapping, which then
+// doubles in size as often as higher ids need it to.
+const mappedFileInitialSize = 1 << 20
+
+// mappedFile is a temporary file mapped into memory.  The operating system
+// pages it in and out as it is used, so that an array indexed by node id can
+// be far larger than the machine's memory; parts never written take no space
+// at all, on disk or in memory.
+type mappedFile struct {
+	file    *os.File
+	data    []byte
+	maxSize int64
+	full    bool // growing the mapping failed, so it keeps its size
+	lock    sync.RWMutex
+}
+
+// storeError reports a memory-mapped store that cannot be made, which is no
+// fault of the input file.
+type storeError struct {
+	err error
+}
+
+func (err *storeError) Error() string {
+	return err.err.Error()
+}
+
+func newMappedFile(maxSize int64) (*mappedFile, error) {
+	file, err := ioutil.TempFile(storeDirectory, "go-osmpbf-filter-")
+	if err != nil {
+		return nil, &storeError{err}
+	}
+
+	mapped := &mappedFile{file: file, maxSize: maxSize}
+	err = mapped.resize(mappedFileInitialSize)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, &storeError{err}
+	}
+
+	// the mapping outlives the file's name, so nothing is left behind on exit
+	os.Remove(file.Name())
+	return mapped, nil
+}
+
+// resize grows the file and maps it again, leaving the old mapping in place
+// if the new one fails.
+func (mapped *mappedFile) resize(size int64) error {
+	if size > mapped.maxSize {
+		size = mapped.maxSize
+	}
+	err := mapped.file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	data, err := mapFile(mapped.file, size)
+	if err != nil {
+		return err
+	}
+	if mapped.data != nil {
+		unmapFile(mapped.data)
+	}
+	mapped.data = data
+	return nil
+}
+
+// reserve grows the mapping to hold at least size bytes, and reports whether
+// it does; it cannot grow beyond maxSize, or once growing has failed.  Writes
+// to the mapping hold the read lock, so that it is not moved under them.
+func (mapped *mappedFile) reserve(size int64) bool {
+	mapped.lock.RLock()
+	reserved := size <= int64(len(mapped.data))
+	mapped.lock.RUnlock()
+	if reserved {
+		return true
+	}
+
+	mapped.lock.Lock()
+	defer mapped.lock.Unlock()
+	if size <= int64(len(mapped.data)) {
+		return true
+	}
+	if mapped.full || size > mapped.maxSize {
+		return false
+	}
+
+	newSize := int64(len(mapped.data))
+	for newSize < size {
+		newSize *= 2
+	}
+	err := mapped.resize(newSize)
+	if err != nil {
+		// ids beyond the mapping go to the overflow maps from now on
+		mapped.full = true
+		return false
+	}
+	return true
+}
+
+// close unmaps and closes the file.
+func (mapped *mappedFile) close() {
+	if mapped.data != nil {
+		unmapFile(mapped.data)
+		mapped.data = nil
+		mapped.file.Close()
+	}
+}
+
+// mappedIdSet is an idSet holding a bit per node id in a mapped file.
+type mappedIdSet struct {
+	bits     *mappedFile
+	overflow map[int64]bool
+}
+
+func newMappedIdSet() (*mappedIdSet, error) {
+	bits, err := newMappedFile(mappedStoreIds / 8)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedIdSet{bits, make(map[int64]bool)}, nil
+}
+
+func (set *mappedIdSet) add(id int64) {
+	if id < 0 || !set.bits.reserve(id>>3+1) {
+		set.overflow[id] = true
+		return
+	}
+	set.bits.lock.RLock()
+	set.bits.data[id>>3] |= 1 << uint(id&7)
+	set.bits.lock.RUnlock()
+}
+
+func (set *mappedIdSet) contains(id int64) bool {
+	if id < 0 || id>>3 >= int64(len(set.bits.data)) {
+		return set.overflow[id]
+	}
+	return set.bits.data[id>>3]&(1<<uint(id&7)) != 0
+}
+
+func (set *mappedIdSet) close() {
+	set.bits.close()
+}
+
+// nodeLocationStore holds the locations of nodes by id.  set is safe for
+// concurrent use, and every location is set before the store is first read.
+// close releases the store's memory, and any file behind it.
+type nodeLocationStore interface {
+	set(nodeId int64, lon float64, lat float64)
+	get(nodeId int64) (float64, float64, bool)
+	close()
+}
+
+// nodeLocationKind selects the nodeLocationStore made by
+// newNodeLocationStore: map, or mmap for an array in a mapped file.
+var nodeLocationKind = "map"
+
+func newNodeLocationStore(capacity int) (nodeLocationStore, error) {
+	if nodeLocationKind == "mmap" {
+		return newMappedNodeLocations()
+	}
+	return newMapNodeLocations(capacity), nil
+}
+
+type mapNodeLocations struct {
+	lock      sync.Mutex
+	locations map[int64][2]float64
+}
+
+func newMapNodeLocations(capacity int) *mapNodeLocations {
+	return &mapNodeLocations{locations: make(map[int64][2]float64, capacity)}
+}
+
+func (store *mapNodeLocations) set(nodeId int64, lon float64, lat float64) {
+	store.lock.Lock()
+	store.locations[nodeId] = [2]float64{lon, lat}
+	store.lock.Unlock()
+}
+
+func (store *mapNodeLocations) get(nodeId int64) (float64, float64, bool) {
+	location, ok := store.locations[nodeId]
+	return location[0], location[1], ok
+}
+
+func (store *mapNodeLocations) close() {
+}
+
+// mappedNodeLocations keeps each location in eight bytes of a mapped file,
+// as a longitude and latitude in units of 100 nanodegrees, offset by 2^31 so
+// that zero is never a valid location and marks an unset node.  get returns
+// the very float64s that the pbf reader decodes from those units, so that
+// bounding boxes made from the store match the nodes the passes read; a
+// location that is not a whole number of units, from a block with a finer
+// granularity, is kept in the overflow map instead.  Locations are set under
+// the mapping's read lock, so that goroutines setting them do not wait for
+// one another.
+type mappedNodeLocations struct {
+	locations *mappedFile
+	overflow  *mapNodeLocations
+}
+
+const mappedLocationOffset = 1 << 31
+
+func newMappedNodeLocations() (*mappedNodeLocations, error) {
+	locations, err := newMappedFile(mappedStoreIds * 8)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedNodeLocations{locations, newMapNodeLocations(0)}, nil
+}
+
+func (store *mappedNodeLocations) set(nodeId int64, lon float64, lat float64) {
+	// the reader decodes .000000001 * nanodegrees, which rounds back to the
+	// same whole number of nanodegrees
+	lonNanodegrees := int64(math.Round(lon * 1e9))
+	latNanodegrees := int64(math.Round(lat * 1e9))
+	if nodeId < 0 || nodeId >= mappedStoreIds || lonNanodegrees%100 != 0 || latNanodegrees%100 != 0 || !store.locations.reserve(nodeId*8+8) {
+		store.overflow.set(nodeId, lon, lat)
+		return
+	}
+	store.locations.lock.RLock()
+	data := store.locations.data
+	putUint32(data[nodeId*8:], uint32(lonNanodegrees/100+mappedLocationOffset))
+	putUint32(data[nodeId*8+4:], uint32(latNanodegrees/100+mappedLocationOffset))
+	store.locations.lock.RUnlock()
+}
+
+func (store *mappedNodeLocations) get(nodeId int64) (float64, float64, bool) {
+	if nodeId < 0 || nodeId >= int64(len(store.locations.data))/8 {
+		return store.overflow.get(nodeId)
+	}
+	rawLon := getUint32(store.locations.data[nodeId*8:])
+	rawLat := getUint32(store.locations.data[nodeId*8+4:])
+	if rawLon == 0 {
+		// a location the map holds is never also in the mapped file
+		return store.overflow.get(nodeId)
+	}
+	lon := .000000001 * float64((int64(rawLon)-mappedLocationOffset)*100)
+	lat := .000000001 * float64((int64(rawLat)-mappedLocationOffset)*100)
+	return lon, lat, true
+}
+
+func (store *mappedNodeLocations) close() {
+	store.locations.close()
+}
+
+func putUint32(b []byte, v uint32) {
+	b[0], b[1], b[2], b[3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+}
+
+func getUint32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
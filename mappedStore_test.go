@@ -0,0 +1,122 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestNodeLocationStores(t *testing.T) {
+	// locations as the pbf reader decodes them from nanodegrees, which the
+	// stores must give back exactly
+	decoded := func(nanodegrees int64) float64 { return .000000001 * float64(nanodegrees) }
+	locations := map[int64][2]float64{
+		1:                  {decoded(-180000000000), decoded(-90000000000)},
+		2:                  {decoded(180000000000), decoded(90000000000)},
+		3:                  {decoded(13377704100), decoded(52516274600)},
+		4:                  {decoded(9000000), decoded(-9000000)},
+		5:                  {decoded(13377704123), decoded(52516274601)},
+		mappedStoreIds - 1: {decoded(-100), 0},
+		mappedStoreIds:     {1.5, 2.5},
+		-5:                 {0, 0},
+	}
+	for i := int64(0); i < 10000; i++ {
+		locations[100+i] = [2]float64{decoded(i * 100), decoded(-i * 300)}
+	}
+
+	for _, kind := range []string{"map", "mmap"} {
+		nodeLocationKind = kind
+		store, err := newNodeLocationStore(len(locations))
+		nodeLocationKind = "map"
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for nodeId, location := range locations {
+			store.set(nodeId, location[0], location[1])
+		}
+		for nodeId, location := range locations {
+			lon, lat, ok := store.get(nodeId)
+			if !ok || lon != location[0] || lat != location[1] {
+				t.Fatalf("%s store: node %d at %v, %v (%v), expected %v", kind, nodeId, lon, lat, ok, location)
+			}
+		}
+		for _, nodeId := range []int64{0, 6, -1, mappedStoreIds + 1} {
+			if _, _, ok := store.get(nodeId); ok {
+				t.Fatalf("%s store: unset node %d found", kind, nodeId)
+			}
+		}
+		store.close()
+	}
+}
+
+func TestMappedStoreGrowth(t *testing.T) {
+	store, err := newMappedNodeLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	set, err := newMappedIdSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.close()
+
+	// each step stores an id beyond the mapping so far, which then holds
+	// every id stored before it
+	steps := []struct {
+		nodeId       int64
+		locationSize int
+		bitSize      int
+	}{
+		{1, mappedFileInitialSize, mappedFileInitialSize},
+		{mappedFileInitialSize / 8, mappedFileInitialSize * 2, mappedFileInitialSize},
+		{mappedFileInitialSize * 8, mappedFileInitialSize * 128, mappedFileInitialSize * 2},
+		{mappedFileInitialSize * 1000, mappedFileInitialSize * 8192, mappedFileInitialSize * 128},
+	}
+	for i, step := range steps {
+		store.set(step.nodeId, float64(i), -float64(i))
+		set.add(step.nodeId)
+		if len(store.locations.data) != step.locationSize || len(set.bits.data) != step.bitSize {
+			t.Fatalf("node %d: mappings of %d and %d bytes, expected %d and %d", step.nodeId, len(store.locations.data), len(set.bits.data), step.locationSize, step.bitSize)
+		}
+		for j, earlier := range steps[:i+1] {
+			lon, lat, ok := store.get(earlier.nodeId)
+			if !ok || lon != float64(j) || lat != -float64(j) || !set.contains(earlier.nodeId) {
+				t.Fatalf("node %d lost after storing node %d", earlier.nodeId, step.nodeId)
+			}
+		}
+		if len(store.overflow.locations) != 0 || len(set.overflow) != 0 {
+			t.Fatalf("node %d: ids stored in the overflow maps", step.nodeId)
+		}
+	}
+
+	// once a mapping cannot grow, higher ids go to the overflow maps
+	store.locations.full = true
+	set.bits.full = true
+	nodeId := int64(mappedFileInitialSize * 10000)
+	store.set(nodeId, 1.5, 2.5)
+	set.add(nodeId)
+	if lon, lat, ok := store.get(nodeId); !ok || lon != 1.5 || lat != 2.5 || len(store.overflow.locations) != 1 {
+		t.Fatalf("node %d at %v, %v (%v) with %d overflowing", nodeId, lon, lat, ok, len(store.overflow.locations))
+	}
+	if !set.contains(nodeId) || len(set.overflow) != 1 {
+		t.Fatalf("node %d missing from the set with %d overflowing", nodeId, len(set.overflow))
+	}
+}
@@ -0,0 +1,169 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"OSMPBF"
+	"bufio"
+	"encoding/xml"
+	"io"
+	"pbf"
+	"strconv"
+	"time"
+)
+
+var osmXmlMemberTypes = map[OSMPBF.Relation_MemberType]string{
+	OSMPBF.Relation_NODE:     "node",
+	OSMPBF.Relation_WAY:      "way",
+	OSMPBF.Relation_RELATION: "relation",
+}
+
+// osmXmlWriter writes OSM XML one element at a time, so that no more than a
+// buffer of the document is held in memory.  The first write error is kept
+// by the bufio.Writer, and returned when it is flushed.
+type osmXmlWriter struct {
+	*bufio.Writer
+}
+
+// writeOsmXml writes the nodes, ways and relations, which must each be sorted
+// by id as uniqueEntities leaves them, as an OSM XML document, with the
+// bounding box of header.
+func writeOsmXml(output io.Writer, header *OSMPBF.HeaderBlock, nodes []pbf.Node, ways []pbf.Way, relations []pbf.Relation) error {
+	writer := osmXmlWriter{bufio.NewWriter(output)}
+
+	writer.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	writer.WriteString("<osm version=\"0.6\" generator=\"go-osmpbf-filter\">\n")
+	if header.Bbox != nil {
+		// header bounding boxes are in nanodegrees
+		writer.WriteString(" <bounds")
+		writer.writeAttribute("minlat", formatNanodegrees(*header.Bbox.Bottom))
+		writer.writeAttribute("minlon", formatNanodegrees(*header.Bbox.Left))
+		writer.writeAttribute("maxlat", formatNanodegrees(*header.Bbox.Top))
+		writer.writeAttribute("maxlon", formatNanodegrees(*header.Bbox.Right))
+		writer.WriteString("/>\n")
+	}
+
+	for _, node := range nodes {
+		writer.writeNode(node)
+	}
+	for _, way := range ways {
+		writer.writeWay(way)
+	}
+	for _, relation := range relations {
+		writer.writeRelation(relation)
+	}
+
+	writer.WriteString("</osm>\n")
+	return writer.Flush()
+}
+
+// formatCoordinate formats degrees to the 100 nanodegree precision of the
+// PBF output.
+func formatCoordinate(degrees float64) string {
+	return strconv.FormatFloat(float64(rawCoordinate(degrees))/1e7, 'f', -1, 64)
+}
+
+func formatNanodegrees(nanodegrees int64) string {
+	return strconv.FormatFloat(float64(nanodegrees)/1e9, 'f', -1, 64)
+}
+
+// writeAttribute writes name="value", escaping the value.
+func (writer osmXmlWriter) writeAttribute(name string, value string) {
+	writer.WriteByte(' ')
+	writer.WriteString(name)
+	writer.WriteString("=\"")
+	xml.EscapeText(writer, []byte(value))
+	writer.WriteByte('"')
+}
+
+func (writer osmXmlWriter) writeStart(element string, id int64, info *pbf.Info) {
+	writer.WriteString(" <")
+	writer.WriteString(element)
+	writer.writeAttribute("id", strconv.FormatInt(id, 10))
+	if info != nil {
+		writer.writeAttribute("version", strconv.FormatInt(int64(info.Version), 10))
+		writer.writeAttribute("timestamp", time.Unix(0, info.Timestamp*int64(time.Millisecond)).UTC().Format(time.RFC3339))
+		writer.writeAttribute("changeset", strconv.FormatInt(info.Changeset, 10))
+		writer.writeAttribute("uid", strconv.FormatInt(int64(info.Uid), 10))
+		writer.writeAttribute("user", info.User)
+	}
+}
+
+// writeEnd closes an element, which is left empty if it has no children.
+func (writer osmXmlWriter) writeEnd(element string, hasChildren bool) {
+	if !hasChildren {
+		writer.WriteString("/>\n")
+		return
+	}
+	writer.WriteString(" </")
+	writer.WriteString(element)
+	writer.WriteString(">\n")
+}
+
+func (writer osmXmlWriter) writeTags(keys []string, values []string) {
+	for i, key := range keys {
+		writer.WriteString("  <tag")
+		writer.writeAttribute("k", key)
+		writer.writeAttribute("v", values[i])
+		writer.WriteString("/>\n")
+	}
+}
+
+func (writer osmXmlWriter) writeNode(node pbf.Node) {
+	writer.writeStart("node", node.Id, node.Info)
+	writer.writeAttribute("lat", formatCoordinate(node.Lat))
+	writer.writeAttribute("lon", formatCoordinate(node.Lon))
+	if len(node.Keys) != 0 {
+		writer.WriteString(">\n")
+		writer.writeTags(node.Keys, node.Values)
+	}
+	writer.writeEnd("node", len(node.Keys) != 0)
+}
+
+func (writer osmXmlWriter) writeWay(way pbf.Way) {
+	writer.writeStart("way", way.Id, way.Info)
+	hasChildren := len(way.NodeIds) != 0 || len(way.Keys) != 0
+	if hasChildren {
+		writer.WriteString(">\n")
+	}
+	for _, nodeId := range way.NodeIds {
+		writer.WriteString("  <nd")
+		writer.writeAttribute("ref", strconv.FormatInt(nodeId, 10))
+		writer.WriteString("/>\n")
+	}
+	writer.writeTags(way.Keys, way.Values)
+	writer.writeEnd("way", hasChildren)
+}
+
+func (writer osmXmlWriter) writeRelation(relation pbf.Relation) {
+	writer.writeStart("relation", relation.Id, relation.Info)
+	hasChildren := len(relation.MemberIds) != 0 || len(relation.Keys) != 0
+	if hasChildren {
+		writer.WriteString(">\n")
+	}
+	for i, memberId := range relation.MemberIds {
+		writer.WriteString("  <member")
+		writer.writeAttribute("type", osmXmlMemberTypes[relation.MemberTypes[i]])
+		writer.writeAttribute("ref", strconv.FormatInt(memberId, 10))
+		writer.writeAttribute("role", relation.MemberRoles[i])
+		writer.WriteString("/>\n")
+	}
+	writer.writeTags(relation.Keys, relation.Values)
+	writer.writeEnd("relation", hasChildren)
+}
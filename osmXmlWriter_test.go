@@ -0,0 +1,131 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"OSMPBF"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"pbf"
+	"reflect"
+	"testing"
+)
+
+type osmXmlTag struct {
+	Key   string `xml:"k,attr"`
+	Value string `xml:"v,attr"`
+}
+
+type osmXmlElement struct {
+	Id        int64   `xml:"id,attr"`
+	Lat       float64 `xml:"lat,attr"`
+	Lon       float64 `xml:"lon,attr"`
+	Version   int32   `xml:"version,attr"`
+	Timestamp string  `xml:"timestamp,attr"`
+	User      string  `xml:"user,attr"`
+	NodeRefs  []struct {
+		Ref int64 `xml:"ref,attr"`
+	} `xml:"nd"`
+	Members []struct {
+		Type string `xml:"type,attr"`
+		Ref  int64  `xml:"ref,attr"`
+		Role string `xml:"role,attr"`
+	} `xml:"member"`
+	Tags []osmXmlTag `xml:"tag"`
+}
+
+type osmXmlDocument struct {
+	Bounds struct {
+		MinLat float64 `xml:"minlat,attr"`
+		MaxLon float64 `xml:"maxlon,attr"`
+	} `xml:"bounds"`
+	Nodes     []osmXmlElement `xml:"node"`
+	Ways      []osmXmlElement `xml:"way"`
+	Relations []osmXmlElement `xml:"relation"`
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteOsmXml(t *testing.T) {
+	awkward := "<\"Fish & Chips\">\n'\x01'"
+	nodes := []pbf.Node{
+		{Id: 3, Lon: 13.3777041, Lat: -52.5162746, Info: &pbf.Info{Version: 2, Timestamp: 1349092800000, Changeset: 5, Uid: 9, User: "a&b"}},
+		{Id: 7, Lon: -0.1276, Lat: 51.5072, Keys: []string{"name", "amenity"}, Values: []string{awkward, "restaurant"}},
+	}
+	ways := []pbf.Way{{Id: 10, NodeIds: []int64{3, 7, 3}, Keys: []string{"leisure"}, Values: []string{"golf_course"}}}
+	relations := []pbf.Relation{{
+		Id:          20,
+		MemberIds:   []int64{10, 3},
+		MemberTypes: []OSMPBF.Relation_MemberType{OSMPBF.Relation_WAY, OSMPBF.Relation_NODE},
+		MemberRoles: []string{"outer", "<label>"},
+	}}
+	header := makeOutputHeader(nil, nodes, nil)
+
+	var output bytes.Buffer
+	err := writeOsmXml(&output, header, nodes, ways, relations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var document osmXmlDocument
+	err = xml.Unmarshal(output.Bytes(), &document)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, output.String())
+	}
+
+	if document.Bounds.MinLat != -52.5162746 || document.Bounds.MaxLon != 13.3777041 {
+		t.Errorf("bounds %+v", document.Bounds)
+	}
+	if len(document.Nodes) != 2 || document.Nodes[0].Id != 3 || document.Nodes[1].Id != 7 {
+		t.Fatalf("nodes %+v, expected 3 then 7", document.Nodes)
+	}
+	if document.Nodes[0].Lat != -52.5162746 || document.Nodes[0].Lon != 13.3777041 {
+		t.Errorf("node 3 at %v, %v", document.Nodes[0].Lat, document.Nodes[0].Lon)
+	}
+	if document.Nodes[0].Version != 2 || document.Nodes[0].Timestamp != "2012-10-01T12:00:00Z" || document.Nodes[0].User != "a&b" {
+		t.Errorf("node 3 metadata %+v", document.Nodes[0])
+	}
+
+	// characters that XML cannot carry at all are replaced
+	expectedTags := []osmXmlTag{{"name", "<\"Fish & Chips\">\n'�'"}, {"amenity", "restaurant"}}
+	if !reflect.DeepEqual(document.Nodes[1].Tags, expectedTags) {
+		t.Errorf("node 7 tags %+v, expected %+v", document.Nodes[1].Tags, expectedTags)
+	}
+
+	if len(document.Ways) != 1 || len(document.Ways[0].NodeRefs) != 3 || document.Ways[0].NodeRefs[1].Ref != 7 || len(document.Ways[0].Tags) != 1 {
+		t.Errorf("ways %+v", document.Ways)
+	}
+	if len(document.Relations) != 1 || len(document.Relations[0].Members) != 2 {
+		t.Fatalf("relations %+v", document.Relations)
+	}
+	member := document.Relations[0].Members[1]
+	if member.Type != "node" || member.Ref != 3 || member.Role != "<label>" {
+		t.Errorf("relation member %+v", member)
+	}
+
+	err = writeOsmXml(failingWriter{}, header, nodes, ways, relations)
+	if err == nil {
+		t.Error("write error not returned")
+	}
+}
@@ -0,0 +1,624 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"OSMPBF"
+	"code.google.com/p/goprotobuf/proto"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"pbf"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// passFixture is a synthetic data set for the filter passes: a grid of nodes,
+// short ways along it, and multipolygon relations over some of the ways.
+// Every fiftieth way and every relation is tagged leisure=golf_course, and
+// every thousandth node amenity=bench.
+type passFixture struct {
+	nodes     []pbf.Node
+	ways      []pbf.Way
+	relations []pbf.Relation
+}
+
+func newPassFixture(nodeCount int) *passFixture {
+	fixture := &passFixture{}
+	for i := 0; i < nodeCount; i++ {
+		fixture.nodes = append(fixture.nodes, pbf.Node{
+			Id:  int64(i + 1),
+			Lon: float64(i%250) * 0.001,
+			Lat: float64(i/250) * 0.001,
+		})
+		if i%1000 == 0 {
+			fixture.nodes[i].Keys = []string{"amenity"}
+			fixture.nodes[i].Values = []string{"bench"}
+		}
+	}
+
+	for i := 0; i+4 <= nodeCount; i += 3 {
+		nodeIds := []int64{int64(i + 1), int64(i + 2), int64(i + 252), int64(i + 1)}
+		if nodeIds[2] > int64(nodeCount) {
+			nodeIds = nodeIds[:2]
+		}
+		way := pbf.Way{Id: int64(len(fixture.ways) + 1), NodeIds: nodeIds}
+		if len(fixture.ways)%50 == 0 {
+			way.Keys = []string{"leisure"}
+			way.Values = []string{"golf_course"}
+		}
+		fixture.ways = append(fixture.ways, way)
+	}
+
+	for i := 0; i < 10; i++ {
+		outerWayId := int64(len(fixture.ways) - 1000*i - 7)
+		fixture.relations = append(fixture.relations, pbf.Relation{
+			Id:          int64(i + 1),
+			MemberIds:   []int64{outerWayId, int64(i*4000 + 17)},
+			MemberTypes: []OSMPBF.Relation_MemberType{OSMPBF.Relation_WAY, OSMPBF.Relation_NODE},
+			MemberRoles: []string{"outer", ""},
+			Keys:        []string{"type", "leisure"},
+			Values:      []string{"multipolygon", "golf_course"},
+		})
+	}
+
+	return fixture
+}
+
+// writeFile writes the fixture to a PBF file in a temporary directory, and
+// opens it for reading.
+func (fixture *passFixture) writeFile(tb testing.TB) *os.File {
+	return fixture.writeFormattedFile(tb, true, "zlib", true)
+}
+
+// writeFormattedFile is writeFile with the node format and compression given,
+// as for -sparse-nodes and -compression.  An unsorted file has a header that
+// does not declare Sort.Type_then_ID, and its relations, ways and nodes in
+// that order, each in descending order of id.
+func (fixture *passFixture) writeFormattedFile(tb testing.TB, denseNodes bool, compression string, sorted bool) *os.File {
+	defer func(previousCompression blobCompression) { outputCompression = previousCompression }(outputCompression)
+	var err error
+	outputCompression, err = parseBlobCompression(compression)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	path := filepath.Join(tb.TempDir(), "fixture.osm.pbf")
+	output, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	writer := newBlockWriter(output)
+	if sorted {
+		err = WriteHeader(output, &OSMPBF.HeaderBlock{}, denseNodes)
+		if err == nil {
+			err = writeNodes(writer, fixture.nodes, denseNodes)
+		}
+		if err == nil {
+			err = writeWays(writer, fixture.ways)
+		}
+		if err == nil {
+			err = writeRelations(writer, fixture.relations)
+		}
+	} else {
+		// WriteHeader would declare the file sorted
+		header := &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6"}}
+		if denseNodes {
+			header.RequiredFeatures = append(header.RequiredFeatures, "DenseNodes")
+		}
+		err = WriteBlock(output, header, "OSMHeader")
+
+		relations := append([]pbf.Relation(nil), fixture.relations...)
+		sort.Slice(relations, func(i, j int) bool { return relations[i].Id > relations[j].Id })
+		ways := append([]pbf.Way(nil), fixture.ways...)
+		sort.Slice(ways, func(i, j int) bool { return ways[i].Id > ways[j].Id })
+		nodes := append([]pbf.Node(nil), fixture.nodes...)
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id > nodes[j].Id })
+		if err == nil {
+			err = writeRelations(writer, relations)
+		}
+		if err == nil {
+			err = writeWays(writer, ways)
+		}
+		if err == nil {
+			err = writeNodes(writer, nodes, denseNodes)
+		}
+	}
+	if err == nil {
+		err = writer.close()
+	}
+	if err == nil {
+		err = output.Close()
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { file.Close() })
+	return file
+}
+
+// expectedPassResults works out the results of each pass over the fixture
+// with plain loops over its entities.
+type expectedPassResults struct {
+	seedNodes     []int64
+	matchingWays  []int64
+	outerWays     []int64
+	boxNodes      []int64
+	ways          []int64
+	nodes         []int64
+	relationCount int
+}
+
+func (fixture *passFixture) expectedResults(filter tagFilter) expectedPassResults {
+	var expected expectedPassResults
+	nodeLocations := make(map[int64]pbf.Node)
+	for _, node := range fixture.nodes {
+		nodeLocations[node.Id] = node
+	}
+
+	for _, node := range fixture.nodes {
+		if len(node.Keys) != 0 && filter.matches(node.Keys, node.Values) {
+			expected.seedNodes = append(expected.seedNodes, node.Id)
+		}
+	}
+
+	var boundingBoxes [][]float64
+	addBoundingBox := func(way pbf.Way) {
+		boundingBox := []float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+		for _, nodeId := range way.NodeIds {
+			node := nodeLocations[nodeId]
+			boundingBox = []float64{math.Min(boundingBox[0], node.Lon), math.Min(boundingBox[1], node.Lat), math.Max(boundingBox[2], node.Lon), math.Max(boundingBox[3], node.Lat)}
+		}
+		boundingBoxes = append(boundingBoxes, boundingBox)
+	}
+
+	memberWays := make(map[int64]bool)
+	memberNodes := make(map[int64]bool)
+	for _, relation := range fixture.relations {
+		if !filter.matches(relation.Keys, relation.Values) {
+			continue
+		}
+		expected.relationCount += 1
+		for i, memberId := range relation.MemberIds {
+			if relation.MemberTypes[i] == OSMPBF.Relation_WAY {
+				memberWays[memberId] = true
+			} else if relation.MemberTypes[i] == OSMPBF.Relation_NODE {
+				memberNodes[memberId] = true
+			}
+		}
+	}
+
+	for _, way := range fixture.ways {
+		if filter.matches(way.Keys, way.Values) {
+			expected.matchingWays = append(expected.matchingWays, way.NodeIds[0])
+			addBoundingBox(way)
+		}
+		if memberWays[way.Id] {
+			expected.outerWays = append(expected.outerWays, way.NodeIds[0])
+			addBoundingBox(way)
+		}
+	}
+
+	boxNodes := make(map[int64]bool)
+	for _, node := range fixture.nodes {
+		if isInBoundingBoxes(boundingBoxes, node.Lon, node.Lat) {
+			boxNodes[node.Id] = true
+			expected.boxNodes = append(expected.boxNodes, node.Id)
+		}
+	}
+
+	nodes := make(map[int64]bool)
+	for nodeId := range boxNodes {
+		nodes[nodeId] = true
+	}
+	for nodeId := range memberNodes {
+		nodes[nodeId] = true
+	}
+	for _, way := range fixture.ways {
+		uses := memberWays[way.Id]
+		for _, nodeId := range way.NodeIds {
+			uses = uses || boxNodes[nodeId]
+		}
+		if uses {
+			expected.ways = append(expected.ways, way.Id)
+			for _, nodeId := range way.NodeIds {
+				nodes[nodeId] = true
+			}
+		}
+	}
+	for nodeId := range nodes {
+		expected.nodes = append(expected.nodes, nodeId)
+	}
+
+	sortIds(expected.matchingWays)
+	sortIds(expected.outerWays)
+	sortIds(expected.nodes)
+	return expected
+}
+
+func sortIds(ids []int64) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+func firstNodeIds(wayNodeRefs [][]int64) []int64 {
+	ids := make([]int64, len(wayNodeRefs))
+	for i, nodeIds := range wayNodeRefs {
+		ids[i] = nodeIds[0]
+	}
+	sortIds(ids)
+	return ids
+}
+
+func nodeIds(nodes []pbf.Node) []int64 {
+	ids := make([]int64, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.Id
+	}
+	sortIds(ids)
+	return ids
+}
+
+func wayIds(ways []pbf.Way) []int64 {
+	ids := make([]int64, len(ways))
+	for i, way := range ways {
+		ids[i] = way.Id
+	}
+	sortIds(ids)
+	return ids
+}
+
+func checkIds(t *testing.T, description string, ids []int64, expected []int64) {
+	t.Helper()
+	if len(ids) != len(expected) {
+		t.Fatalf("%s: %d found, expected %d", description, len(ids), len(expected))
+	}
+	for i, id := range ids {
+		if id != expected[i] {
+			t.Fatalf("%s: found %d, expected %d", description, id, expected[i])
+		}
+	}
+}
+
+// TestPasses runs every pass, looking for seed nodes as well, over a fixture
+// of many blocks written with dense and sparse nodes, compressed and not, and
+// out of order, and compares the results with those worked out directly from
+// the fixture.  The passes share their lookup structures between worker
+// goroutines, so this is best run with -race.
+func TestPasses(t *testing.T) {
+	fixture := newPassFixture(40000)
+	filter, err := parseTagFilter("leisure=golf_course or amenity=bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fixture.expectedResults(filter)
+
+	formats := []struct {
+		name        string
+		denseNodes  bool
+		compression string
+		sorted      bool
+	}{
+		{"dense nodes, zlib blobs", true, "zlib", true},
+		{"sparse nodes, raw blobs", false, "none", true},
+		{"dense nodes, unsorted", true, "zlib", false},
+	}
+
+	for _, format := range formats {
+		file := fixture.writeFormattedFile(t, format.denseNodes, format.compression, format.sorted)
+		checkPasses(t, format.name, file, filter, expected, format.sorted)
+	}
+}
+
+// checkPasses runs every pass over file with each id set, with and without
+// the -high-memory blob cache, and with the node locations kept from pass 2
+// in each kind of store, or not kept.
+func checkPasses(t *testing.T, name string, file *os.File, filter tagFilter, expected expectedPassResults, sorted bool) {
+	defer func(previousKind string) { idSetKind = previousKind }(idSetKind)
+	defer func(previousKind string) { nodeLocationKind = previousKind }(nodeLocationKind)
+	defer func() { cacheUncompressedBlobs = nil }()
+
+	for _, kind := range idSetKinds {
+		for _, highMemory := range []bool{false, true} {
+			for _, locationKind := range []string{"", "map", "mmap"} {
+				idSetKind = kind
+				cacheUncompressedBlobs = nil
+				if highMemory {
+					cacheUncompressedBlobs = make(map[int64][]byte)
+				}
+				passesName := name + ", " + kind + " id set"
+				if highMemory {
+					passesName += ", high memory"
+				}
+				if locationKind != "" {
+					passesName += ", " + locationKind + " node locations"
+				}
+				runPasses(t, passesName, file, filter, expected, sorted, locationKind)
+			}
+		}
+	}
+}
+
+// runPasses runs every pass over file once.  With a locationKind, the node
+// locations are kept from pass 2 in a store of that kind, and the passes after
+// pass 4 use the bounding boxes made from them, as main does.
+func runPasses(t *testing.T, name string, file *os.File, filter tagFilter, expected expectedPassResults, sorted bool, locationKind string) {
+	ctx := context.Background()
+
+	header, err := supportedFilePass(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isSortedByTypeThenId(header) != sorted {
+		t.Fatalf("%s: header declares Sort.Type_then_ID %v, expected %v", name, isSortedByTypeThenId(header), sorted)
+	}
+
+	var nodeLocations nodeLocationStore
+	if locationKind != "" {
+		nodeLocationKind = locationKind
+		nodeLocations, err = newNodeLocationStore(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nodeLocations.close()
+	}
+	wayNodeRefs, relations, seedNodes, err := findMatchingWaysPass(ctx, file, filter, true, nodeLocations, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIds(t, name+": seed nodes", nodeIds(seedNodes), expected.seedNodes)
+	checkIds(t, name+": matching ways", firstNodeIds(wayNodeRefs), expected.matchingWays)
+	if len(relations) != expected.relationCount {
+		t.Fatalf("%s: %d matching relations, expected %d", name, len(relations), expected.relationCount)
+	}
+
+	outerWayNodeRefs, memberRelations, err := findRelationMembersPass(ctx, file, relations, make(map[int64]bool), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIds(t, name+": outer ways", firstNodeIds(outerWayNodeRefs), expected.outerWays)
+	if len(memberRelations) != 0 {
+		t.Fatalf("%s: %d member relations found, expected none", name, len(memberRelations))
+	}
+	wayNodeRefs = append(wayNodeRefs, outerWayNodeRefs...)
+
+	boundingBoxes, _, err := calculateBoundingBoxesPass(ctx, file, wayNodeRefs, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeLocations != nil {
+		// the boxes must match exactly, or nodes on their edges are missed
+		cachedBoundingBoxes := calculateBoundingBoxes(wayNodeRefs, nodeLocations)
+		for i, boundingBox := range boundingBoxes {
+			if !reflect.DeepEqual(cachedBoundingBoxes[i], boundingBox) {
+				t.Fatalf("%s: bounding box %v from node locations, expected %v", name, cachedBoundingBoxes[i], boundingBox)
+			}
+		}
+		boundingBoxes = cachedBoundingBoxes
+	}
+
+	nodes, err := findNodesWithinBoundingBoxesPass(ctx, file, boundingBoxes, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIds(t, name+": pass 5 nodes", nodeIds(nodes), expected.boxNodes)
+
+	ways, err := findWaysUsingNodesPass(ctx, file, nodes, relations, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIds(t, name+": pass 6 ways", wayIds(ways), expected.ways)
+
+	sortedNodes, sortedWays, err := findNodesAndWaysWithinBoundingBoxesPass(ctx, file, boundingBoxes, nil, relations, 0)
+	if !sorted {
+		if err != errUnsortedInput {
+			t.Fatalf("%s: pass 5-6 error %v, expected errUnsortedInput", name, err)
+		}
+	} else if err != nil {
+		t.Fatal(err)
+	} else {
+		checkIds(t, name+": pass 5-6 nodes", nodeIds(sortedNodes), expected.boxNodes)
+		checkIds(t, name+": pass 5-6 ways", wayIds(sortedWays), expected.ways)
+	}
+
+	nodes, err = findNodesReferencedByWaysPass(ctx, file, ways, relations, nodes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIds(t, name+": pass 7 nodes", nodeIds(nodes), expected.nodes)
+}
+
+func relationIds(relations []pbf.Relation) []int64 {
+	ids := make([]int64, len(relations))
+	for i, relation := range relations {
+		ids[i] = relation.Id
+	}
+	sortIds(ids)
+	return ids
+}
+
+// TestFindRelationMembersPass follows nested relations a level per pass,
+// through a cycle and a member missing from the file.
+func TestFindRelationMembersPass(t *testing.T) {
+	way, relation := OSMPBF.Relation_WAY, OSMPBF.Relation_RELATION
+	fixture := &passFixture{
+		nodes: []pbf.Node{{Id: 1}, {Id: 2, Lon: 1}, {Id: 3, Lat: 1}},
+		ways: []pbf.Way{
+			{Id: 4, NodeIds: []int64{1, 2}},
+			{Id: 5, NodeIds: []int64{2, 3, 2}},
+		},
+		relations: []pbf.Relation{{
+			Id:          1,
+			MemberIds:   []int64{2, 4},
+			MemberTypes: []OSMPBF.Relation_MemberType{relation, way},
+			MemberRoles: []string{"", ""},
+		}, {
+			Id:          2,
+			MemberIds:   []int64{3, 1, 5},
+			MemberTypes: []OSMPBF.Relation_MemberType{relation, relation, way},
+			MemberRoles: []string{"", "", "outer"},
+		}, {
+			Id:          3,
+			MemberIds:   []int64{5, 99},
+			MemberTypes: []OSMPBF.Relation_MemberType{way, relation},
+			MemberRoles: []string{"outer", ""},
+			Keys:        []string{"type"},
+			Values:      []string{"multipolygon"},
+		}, {
+			Id:          4,
+			MemberIds:   []int64{1},
+			MemberTypes: []OSMPBF.Relation_MemberType{relation},
+			MemberRoles: []string{""},
+		}},
+	}
+	file := fixture.writeFile(t)
+
+	knownRelations := map[int64]bool{1: true}
+	pendingRelations := fixture.relations[:1]
+	expectedRounds := []struct {
+		relations []int64
+		outerWays []int64
+	}{
+		{[]int64{2}, nil},
+		{[]int64{3}, nil},
+		{nil, []int64{2}},
+	}
+	for round, expected := range expectedRounds {
+		outerWayNodeRefs, memberRelations, err := findRelationMembersPass(context.Background(), file, pendingRelations, knownRelations, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIds(t, fmt.Sprintf("round %d member relations", round+1), relationIds(memberRelations), expected.relations)
+		checkIds(t, fmt.Sprintf("round %d outer ways", round+1), firstNodeIds(outerWayNodeRefs), expected.outerWays)
+		pendingRelations = memberRelations
+	}
+	if len(knownRelations) != 3 {
+		t.Errorf("known relations %v, expected 1, 2 and 3", knownRelations)
+	}
+}
+
+// writeBlocks writes each of the fixtures in turn, in blocks of its own, under
+// a header that declares the file sorted by type then id whether it is or not.
+func writeBlocks(t *testing.T, fixtures []passFixture) *os.File {
+	output, err := os.Create(filepath.Join(t.TempDir(), "blocks.osm.pbf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { output.Close() })
+
+	err = WriteHeader(output, &OSMPBF.HeaderBlock{}, true)
+	writer := newBlockWriter(output)
+	for _, fixture := range fixtures {
+		if err == nil {
+			err = writeNodes(writer, fixture.nodes, true)
+		}
+		if err == nil {
+			err = writeWays(writer, fixture.ways)
+		}
+		if err == nil {
+			err = writeRelations(writer, fixture.relations)
+		}
+	}
+	if err == nil {
+		err = writer.close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+func TestSortedPassOrder(t *testing.T) {
+	nodes := func(ids ...int64) passFixture {
+		fixture := passFixture{}
+		for _, id := range ids {
+			fixture.nodes = append(fixture.nodes, pbf.Node{Id: id, Lon: 1, Lat: 1})
+		}
+		return fixture
+	}
+	ways := func(ids ...int64) passFixture {
+		fixture := passFixture{}
+		for _, id := range ids {
+			fixture.ways = append(fixture.ways, pbf.Way{Id: id, NodeIds: []int64{1}})
+		}
+		return fixture
+	}
+	relations := passFixture{relations: []pbf.Relation{{Id: 1}}}
+
+	tests := []struct {
+		name   string
+		blocks []passFixture
+		sorted bool
+	}{
+		{"sorted", []passFixture{nodes(1, 2), nodes(2, 5), ways(1, 2), ways(3), relations}, true},
+		{"node ids decrease", []passFixture{nodes(3, 4), nodes(1, 2), ways(1)}, false},
+		{"way ids decrease", []passFixture{nodes(1, 2), ways(3, 4), ways(1, 2)}, false},
+		{"nodes after ways", []passFixture{nodes(1), ways(1), nodes(2)}, false},
+		{"ways after relations", []passFixture{nodes(1), relations, ways(1)}, false},
+	}
+
+	box := [][]float64{{0, 0, 2, 2}}
+	for _, test := range tests {
+		file := writeBlocks(t, test.blocks)
+		_, _, err := findNodesAndWaysWithinBoundingBoxesPass(context.Background(), file, box, nil, nil, 0)
+		if test.sorted && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.sorted && err != errUnsortedInput {
+			t.Errorf("%s: error %v, expected errUnsortedInput", test.name, err)
+		}
+	}
+}
+
+func TestEntityRuns(t *testing.T) {
+	sparseNodes := func(ids ...int64) []*OSMPBF.Node {
+		nodes := make([]*OSMPBF.Node, len(ids))
+		for i := range ids {
+			nodes[i] = &OSMPBF.Node{Id: &ids[i]}
+		}
+		return nodes
+	}
+
+	tests := []struct {
+		name   string
+		groups []*OSMPBF.PrimitiveGroup
+		runs   []entityRun
+		sorted bool
+	}{
+		{"sparse", []*OSMPBF.PrimitiveGroup{{Nodes: sparseNodes(1, 3, 3, 7)}}, []entityRun{{nodeEntity, 1, 7}}, true},
+		{"dense", []*OSMPBF.PrimitiveGroup{{Dense: &OSMPBF.DenseNodes{Id: []int64{5, 1, 4}}}}, []entityRun{{nodeEntity, 5, 10}}, true},
+		{"dense, decreasing", []*OSMPBF.PrimitiveGroup{{Dense: &OSMPBF.DenseNodes{Id: []int64{5, -1, 4}}}}, []entityRun{{nodeEntity, 5, 8}}, false},
+		{"sparse, decreasing", []*OSMPBF.PrimitiveGroup{{Nodes: sparseNodes(2, 1)}}, []entityRun{{nodeEntity, 2, 1}}, false},
+		{"types in turn", []*OSMPBF.PrimitiveGroup{{Nodes: sparseNodes(9)}, {Nodes: sparseNodes(10)}, {Ways: []*OSMPBF.Way{{Id: proto.Int64(4)}}}, {Relations: []*OSMPBF.Relation{{Id: proto.Int64(2)}}}}, []entityRun{{nodeEntity, 9, 10}, {wayEntity, 4, 4}, {relationEntity, 2, 2}}, true},
+	}
+
+	for _, test := range tests {
+		runs, sorted := entityRuns(&OSMPBF.PrimitiveBlock{Primitivegroup: test.groups})
+		if !reflect.DeepEqual(runs, test.runs) || sorted != test.sorted {
+			t.Errorf("%s: runs %v, %v, expected %v, %v", test.name, runs, sorted, test.runs, test.sorted)
+		}
+	}
+}
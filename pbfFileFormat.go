@@ -22,155 +22,321 @@ import (
 	"OSMPBF"
 	"bytes"
 	"code.google.com/p/goprotobuf/proto"
-	"compress/zlib"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 	"os"
+	"pbf"
+	"runtime"
+	"sort"
+	"sync"
 )
 
+// cacheUncompressedBlobs keeps decompressed blobs by file position for the
+// later passes of -high-memory; its lock is held while the decoding
+// goroutines read or add to it.
 var cacheUncompressedBlobs map[int64][]byte
-
-type blockData struct {
-	blobHeader   *OSMPBF.BlobHeader
-	blobData     []byte
-	filePosition int64
+var cacheUncompressedBlobsLock sync.RWMutex
+
+// forEachPrimitiveBlock decodes the OSMData blocks of file on several
+// goroutines, calling process for each one.  It reports progress as it goes,
+// and returns the first error encountered, after which no further blocks are
+// processed.
+func forEachPrimitiveBlock(ctx context.Context, file *os.File, totalBlobCount int, process func(primitiveBlock *OSMPBF.PrimitiveBlock)) error {
+	return forEachSortedPrimitiveBlock(ctx, file, totalBlobCount, process, nil)
 }
 
-func readBlock(file io.Reader, size int32) ([]byte, error) {
-	buffer := make([]byte, size)
-	var idx int32 = 0
-	for {
-		cnt, err := file.Read(buffer[idx:])
-		if err != nil {
-			return nil, err
-		}
-		idx += int32(cnt)
-		if idx == size {
-			break
+// errUnsortedInput reports a file that is not sorted by type then id,
+// although its header says that it is.
+var errUnsortedInput = errors.New("input file is not sorted by type then id, although its header says it is")
+
+// forEachSortedPrimitiveBlock is forEachPrimitiveBlock in two stages, for
+// files sorted by type then id.  Every block is passed to processNodes, and
+// blocks holding ways are then passed to processWays, but only once
+// processNodes has returned for every earlier block in the file.  As every
+// node of a sorted file comes before every way, processWays can rely on all
+// of the nodes having been seen.  processWays may be nil.
+//
+// With processWays, the order of the file's entities is checked as well,
+// and errUnsortedInput is returned once every block has been processed if a
+// node follows a way or relation, a way follows a relation, or the ids of
+// one type decrease.
+func forEachSortedPrimitiveBlock(ctx context.Context, file *os.File, totalBlobCount int, processNodes func(primitiveBlock *OSMPBF.PrimitiveBlock), processWays func(primitiveBlock *OSMPBF.PrimitiveBlock)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workerCount := runtime.NumCPU() * 2
+	blockDataReader, readErrs := pbf.MakePrimitiveBlockReader(ctx, io.NewSectionReader(file, 0, math.MaxInt64))
+	decodeErrs := make(chan error, workerCount)
+	pending := make(chan bool)
+
+	// number the blocks in file order, before the workers pick them up
+	sequencedBlocks := make(chan sequencedBlockData)
+	go func() {
+		defer close(sequencedBlocks)
+		sequence := 0
+		for data := range blockDataReader {
+			select {
+			case sequencedBlocks <- sequencedBlockData{data, sequence}:
+				sequence += 1
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+
+	barrier := newBlockBarrier()
+
+	// the runs of entities in each block, by sequence, to check their order
+	// once the blocks have all been read
+	var runsLock sync.Mutex
+	blockRuns := make(map[int][]entityRun)
+	unsorted := false
+
+	var workers sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for data := range sequencedBlocks {
+				var primitiveBlock *OSMPBF.PrimitiveBlock
+				if *data.BlobHeader.Type == "OSMData" {
+					var err error
+					primitiveBlock, err = decodeBlock(data.BlockData)
+					if err != nil {
+						barrier.markDone(data.sequence)
+						decodeErrs <- err
+						cancel()
+						return
+					}
+					processNodes(primitiveBlock)
+				}
+				barrier.markDone(data.sequence)
+
+				if processWays != nil && primitiveBlock != nil {
+					runs, sorted := entityRuns(primitiveBlock)
+					runsLock.Lock()
+					blockRuns[data.sequence] = runs
+					unsorted = unsorted || !sorted
+					runsLock.Unlock()
+				}
+
+				if processWays != nil && primitiveBlock != nil && hasWays(primitiveBlock) {
+					barrier.waitBefore(data.sequence)
+					processWays(primitiveBlock)
+				}
+
+				pending <- true
+			}
+		}()
 	}
-	return buffer, nil
-}
 
-func ReadNextBlobHeader(file *os.File) (*OSMPBF.BlobHeader, error) {
-	var blobHeaderSize int32
+	go func() {
+		workers.Wait()
+		close(pending)
+	}()
 
-	err := binary.Read(file, binary.BigEndian, &blobHeaderSize)
-	if err != nil {
-		return nil, err
+	blobCount := 0
+	for _ = range pending {
+		blobCount += 1
+		if blobCount%500 == 0 {
+			println("\tComplete:", blobCount, "\tRemaining:", totalBlobCount-blobCount)
+		}
 	}
 
-	if blobHeaderSize < 0 || blobHeaderSize > (64*1024*1024) {
-		return nil, err
+	select {
+	case err := <-decodeErrs:
+		return err
+	default:
 	}
-
-	blobHeaderBytes, err := readBlock(file, blobHeaderSize)
+	err := <-readErrs
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	blobHeader := &OSMPBF.BlobHeader{}
-	err = proto.Unmarshal(blobHeaderBytes, blobHeader)
-	if err != nil {
-		return nil, err
+	if processWays != nil && (unsorted || !isSortedSequence(blockRuns)) {
+		return errUnsortedInput
 	}
+	return nil
+}
 
-	return blobHeader, nil
+// entityRun is a run of entities of one type, in a block, from the first id
+// to the last.
+type entityRun struct {
+	entityType int
+	firstId    int64
+	lastId     int64
 }
 
-func DecodeBlob(data blockData) ([]byte, error) {
-	var blobContent []byte
+const (
+	nodeEntity = iota
+	wayEntity
+	relationEntity
+)
 
-	if cacheUncompressedBlobs != nil {
-		blobContent = cacheUncompressedBlobs[data.filePosition]
-		if blobContent != nil {
-			return blobContent, nil
+// entityRuns finds the runs of entities of each type in a block, in order,
+// and reports whether their ids never decrease within a run.
+func entityRuns(primitiveBlock *OSMPBF.PrimitiveBlock) ([]entityRun, bool) {
+	runs := make([]entityRun, 0, 1)
+	sorted := true
+	add := func(entityType int, id int64) {
+		if last := len(runs) - 1; last >= 0 && runs[last].entityType == entityType {
+			sorted = sorted && id >= runs[last].lastId
+			runs[last].lastId = id
+			return
 		}
+		runs = append(runs, entityRun{entityType, id, id})
 	}
 
-	blob := &OSMPBF.Blob{}
-	err := proto.Unmarshal(data.blobData, blob)
-	if err != nil {
-		return nil, err
+	for _, primitiveGroup := range primitiveBlock.Primitivegroup {
+		for _, node := range primitiveGroup.Nodes {
+			add(nodeEntity, *node.Id)
+		}
+		if primitiveGroup.Dense != nil {
+			var nodeId int64
+			for _, deltaNodeId := range primitiveGroup.Dense.Id {
+				nodeId += deltaNodeId
+				add(nodeEntity, nodeId)
+			}
+		}
+		for _, way := range primitiveGroup.Ways {
+			add(wayEntity, *way.Id)
+		}
+		for _, relation := range primitiveGroup.Relations {
+			add(relationEntity, *relation.Id)
+		}
 	}
+	return runs, sorted
+}
 
-	if blob.Raw != nil {
-		blobContent = blob.Raw
-	} else if blob.ZlibData != nil {
-		if blob.RawSize == nil {
-			return nil, errors.New("decompressed size is required but not provided")
-		}
-		zlibBuffer := bytes.NewBuffer(blob.ZlibData)
-		zlibReader, err := zlib.NewReader(zlibBuffer)
-		if err != nil {
-			return nil, err
+// isSortedSequence tests whether the runs of entities of every block, taken
+// in sequence, go from nodes to ways to relations, with ids that never
+// decrease within each type.
+func isSortedSequence(blockRuns map[int][]entityRun) bool {
+	sequences := make([]int, 0, len(blockRuns))
+	for sequence := range blockRuns {
+		sequences = append(sequences, sequence)
+	}
+	sort.Ints(sequences)
+
+	var previous *entityRun
+	for _, sequence := range sequences {
+		runs := blockRuns[sequence]
+		for i := range runs {
+			run := &runs[i]
+			if previous != nil && (run.entityType < previous.entityType || (run.entityType == previous.entityType && run.firstId < previous.lastId)) {
+				return false
+			}
+			previous = run
 		}
-		blobContent, err = readBlock(zlibReader, *blob.RawSize)
-		if err != nil {
-			return nil, err
+	}
+	return true
+}
+
+type sequencedBlockData struct {
+	pbf.BlockData
+	sequence int
+}
+
+func hasWays(primitiveBlock *OSMPBF.PrimitiveBlock) bool {
+	for _, primitiveGroup := range primitiveBlock.Primitivegroup {
+		if len(primitiveGroup.Ways) > 0 {
+			return true
 		}
-		zlibReader.Close()
-	} else {
-		return nil, errors.New("Unsupported blob storage")
 	}
+	return false
+}
 
-	if cacheUncompressedBlobs != nil {
-		cacheUncompressedBlobs[data.filePosition] = blobContent
+// blockBarrier lets goroutines wait until every block before a given one
+// has been marked done, whatever order the blocks are finished in.
+type blockBarrier struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	done    map[int]bool
+	next    int // the first block that is not done
+}
+
+func newBlockBarrier() *blockBarrier {
+	barrier := &blockBarrier{done: make(map[int]bool)}
+	barrier.changed = sync.NewCond(&barrier.lock)
+	return barrier
+}
+
+func (barrier *blockBarrier) markDone(sequence int) {
+	barrier.lock.Lock()
+	defer barrier.lock.Unlock()
+
+	barrier.done[sequence] = true
+	for barrier.done[barrier.next] {
+		delete(barrier.done, barrier.next)
+		barrier.next += 1
 	}
+	barrier.changed.Broadcast()
+}
+
+func (barrier *blockBarrier) waitBefore(sequence int) {
+	barrier.lock.Lock()
+	defer barrier.lock.Unlock()
 
-	return blobContent, nil
+	for barrier.next < sequence {
+		barrier.changed.Wait()
+	}
 }
 
-func MakePrimitiveBlockReader(file *os.File) <-chan blockData {
-	retval := make(chan blockData)
+// decodeBlock decompresses and decodes an OSMData blob, consulting the blob
+// cache when --high-memory is in use.
+func decodeBlock(data pbf.BlockData) (*OSMPBF.PrimitiveBlock, error) {
+	var blobContent []byte
 
-	go func() {
-		file.Seek(0, os.SEEK_SET)
-		for {
-			filePosition, err := file.Seek(0, os.SEEK_CUR)
-
-			blobHeader, err := ReadNextBlobHeader(file)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				println("Blob header read error:", err.Error())
-				os.Exit(2)
-			}
+	if cacheUncompressedBlobs != nil {
+		cacheUncompressedBlobsLock.RLock()
+		blobContent = cacheUncompressedBlobs[data.FilePosition]
+		cacheUncompressedBlobsLock.RUnlock()
+	}
 
-			blobBytes, err := readBlock(file, *blobHeader.Datasize)
-			if err != nil {
-				println("Blob read error:", err.Error())
-				os.Exit(3)
-			}
+	if blobContent == nil {
+		var err error
+		blobContent, err = pbf.DecodeBlob(data)
+		if err != nil {
+			return nil, err
+		}
 
-			retval <- blockData{blobHeader, blobBytes, filePosition}
+		if cacheUncompressedBlobs != nil {
+			cacheUncompressedBlobsLock.Lock()
+			cacheUncompressedBlobs[data.FilePosition] = blobContent
+			cacheUncompressedBlobsLock.Unlock()
 		}
-		close(retval)
-	}()
+	}
 
-	return retval
+	return pbf.DecodePrimitiveBlock(blobContent, data.FilePosition)
 }
 
 func WriteBlock(file *os.File, block proto.Message, blockType string) error {
-	blobContent, err := proto.Marshal(block)
+	blockBytes, err := encodeBlock(block, blockType)
 	if err != nil {
 		return err
 	}
+	_, err = file.Write(blockBytes)
+	return err
+}
 
-	var blobContentLength int32 = int32(len(blobContent))
-
-	var compressedBlob bytes.Buffer
-	zlibWriter := zlib.NewWriter(&compressedBlob)
-	zlibWriter.Write(blobContent)
-	zlibWriter.Close()
+// encodeBlock marshals and compresses block, returning the blob header
+// length, blob header and blob as they are laid out in the file.
+func encodeBlock(block proto.Message, blockType string) ([]byte, error) {
+	blobContent, err := proto.Marshal(block)
+	if err != nil {
+		return nil, err
+	}
 
-	blob := OSMPBF.Blob{}
-	blob.ZlibData = compressedBlob.Bytes()
-	blob.RawSize = &blobContentLength
-	blobBytes, err := proto.Marshal(&blob)
+	blob, err := compressBlob(blobContent)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	blobBytes, err := proto.Marshal(blob)
+	if err != nil {
+		return nil, err
 	}
 
 	var blobBytesLength int32 = int32(len(blobBytes))
@@ -180,31 +346,33 @@ func WriteBlock(file *os.File, block proto.Message, blockType string) error {
 	blobHeader.Datasize = &blobBytesLength
 	blobHeaderBytes, err := proto.Marshal(&blobHeader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var blobHeaderLength int32 = int32(len(blobHeaderBytes))
 
-	err = binary.Write(file, binary.BigEndian, blobHeaderLength)
-	if err != nil {
-		return err
-	}
-	_, err = file.Write(blobHeaderBytes)
-	if err != nil {
-		return err
-	}
-	_, err = file.Write(blobBytes)
-	if err != nil {
-		return err
-	}
+	var blockBytes bytes.Buffer
+	blockBytes.Grow(4 + len(blobHeaderBytes) + len(blobBytes))
+	binary.Write(&blockBytes, binary.BigEndian, blobHeaderLength)
+	blockBytes.Write(blobHeaderBytes)
+	blockBytes.Write(blobBytes)
 
-	return nil
+	return blockBytes.Bytes(), nil
 }
 
-func WriteHeader(file *os.File) error {
+// WriteHeader writes header as the OSMHeader block, after filling in the
+// writing program and required features, and adding Sort.Type_then_ID to its
+// optional features.
+func WriteHeader(file *os.File, header *OSMPBF.HeaderBlock, denseNodes bool) error {
 	writingProgram := "go-osmpbf-filter"
-	header := OSMPBF.HeaderBlock{}
 	header.Writingprogram = &writingProgram
 	header.RequiredFeatures = []string{"OsmSchema-V0.6"}
-	return WriteBlock(file, &header, "OSMHeader")
+	if denseNodes {
+		header.RequiredFeatures = append(header.RequiredFeatures, "DenseNodes")
+	}
+	// writeNodes, writeWays and writeRelations are given entities sorted by id
+	if !isSortedByTypeThenId(header) {
+		header.OptionalFeatures = append(header.OptionalFeatures, "Sort.Type_then_ID")
+	}
+	return WriteBlock(file, header, "OSMHeader")
 }
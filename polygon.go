@@ -0,0 +1,368 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ring is a closed line of [lon, lat] points; the closing point may be
+// repeated or omitted.
+type ring [][2]float64
+
+// polygon is an outer ring less any holes, grown by buffer metres on every
+// side.  boundingBox covers the buffered outer ring, as minlon, minlat,
+// maxlon, maxlat.
+type polygon struct {
+	outer       ring
+	holes       []ring
+	buffer      float64
+	boundingBox []float64
+}
+
+func newPolygon(outer ring, holes []ring) polygon {
+	boundingBox := []float64{outer[0][0], outer[0][1], outer[0][0], outer[0][1]}
+	for _, point := range outer {
+		boundingBox[0] = math.Min(boundingBox[0], point[0])
+		boundingBox[1] = math.Min(boundingBox[1], point[1])
+		boundingBox[2] = math.Max(boundingBox[2], point[0])
+		boundingBox[3] = math.Max(boundingBox[3], point[1])
+	}
+	return polygon{outer, holes, 0, boundingBox}
+}
+
+// newBufferedPolygon builds a polygon that also takes in everything within
+// buffer metres of the outer ring.
+func newBufferedPolygon(outer ring, buffer float64) polygon {
+	poly := newPolygon(outer, nil)
+	if buffer > 0 {
+		poly.buffer = buffer
+		boundingBoxes := expandBoundingBox(poly.boundingBox, buffer)
+		poly.boundingBox = boundingBoxes[0]
+		if len(boundingBoxes) > 1 {
+			// the rings are not wrapped around the antimeridian, so one box
+			// spanning every longitude stands in for the two halves
+			poly.boundingBox = []float64{-180, poly.boundingBox[1], 180, poly.boundingBox[3]}
+		}
+	}
+	return poly
+}
+
+func (poly *polygon) contains(lon float64, lat float64) bool {
+	box := poly.boundingBox
+	if lon < box[0] || lat < box[1] || lon > box[2] || lat > box[3] {
+		return false
+	}
+	if !poly.outer.contains(lon, lat) {
+		return poly.buffer > 0 && poly.outer.isWithinDistance(lon, lat, poly.buffer)
+	}
+	for _, hole := range poly.holes {
+		if hole.contains(lon, lat) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains is an even-odd ray casting test.
+func (r ring) contains(lon float64, lat float64) bool {
+	inside := false
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		a, b := r[i], r[j]
+		if (a[1] > lat) != (b[1] > lat) && lon < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// containsRing tests whether most of the points of inner are within r, so
+// that a hole sharing some of its points with an outer ring still belongs to
+// it.
+func (r ring) containsRing(inner ring) bool {
+	count := 0
+	for _, point := range inner {
+		if r.contains(point[0], point[1]) {
+			count++
+		}
+	}
+	return count*2 > len(inner)
+}
+
+// isWithinDistance tests whether a point is within the given number of metres
+// of the ring's edges, measuring on a plane tangent to the earth at the point.
+func (r ring) isWithinDistance(lon float64, lat float64, metres float64) bool {
+	lonScale := math.Cos(lat*math.Pi/180) * metresPerDegree
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		// the edge from a to b, relative to the point
+		ax, ay := (r[j][0]-lon)*lonScale, (r[j][1]-lat)*metresPerDegree
+		bx, by := (r[i][0]-lon)*lonScale, (r[i][1]-lat)*metresPerDegree
+
+		dx, dy := bx-ax, by-ay
+		t := 0.0
+		if lengthSquared := dx*dx + dy*dy; lengthSquared > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSquared))
+		}
+		px, py := ax+t*dx, ay+t*dy
+		if px*px+py*py <= metres*metres {
+			return true
+		}
+	}
+	return false
+}
+
+// closedWayPolygons turns the closed ways among wayNodeRefs into polygons,
+// grown by buffer metres.  The bounding boxes of the remaining ways, which
+// have no area of their own, are returned alongside.
+func closedWayPolygons(wayNodeRefs [][]int64, boundingBoxes [][]float64, nodeLocations nodeLocationStore, buffer float64) ([]polygon, [][]float64) {
+	polygons := make([]polygon, 0, len(wayNodeRefs))
+	remainingBoxes := make([][]float64, 0)
+
+	for wayIndex, nodeIds := range wayNodeRefs {
+		closed := len(nodeIds) >= 4 && nodeIds[0] == nodeIds[len(nodeIds)-1]
+
+		outer := make(ring, 0, len(nodeIds))
+		for _, nodeId := range nodeIds {
+			lon, lat, ok := nodeLocations.get(nodeId)
+			if !ok {
+				// a node missing from the input leaves the shape unknown
+				closed = false
+				break
+			}
+			outer = append(outer, [2]float64{lon, lat})
+		}
+
+		if closed {
+			polygons = append(polygons, newBufferedPolygon(outer, buffer))
+		} else if boundingBoxes[wayIndex] != nil {
+			remainingBoxes = append(remainingBoxes, boundingBoxes[wayIndex])
+		}
+	}
+
+	return polygons, remainingBoxes
+}
+
+func isInPolygons(polygons []polygon, lon float64, lat float64) bool {
+	for i := range polygons {
+		if polygons[i].contains(lon, lat) {
+			return true
+		}
+	}
+	return false
+}
+
+// readPolygonFile reads an Osmosis .poly file, or a GeoJSON Polygon,
+// MultiPolygon, Feature or FeatureCollection.
+func readPolygonFile(filename string) ([]polygon, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var polygons []polygon
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '{' {
+		polygons, err = parseGeoJSONPolygons(trimmed)
+	} else {
+		polygons, err = parsePolyFile(content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(polygons) == 0 {
+		return nil, errors.New("no polygons found in " + filename)
+	}
+	return polygons, nil
+}
+
+// parsePolyFile parses the Osmosis polygon filter format: a name line, then
+// sections of "lon lat" lines each ending with END, and a final END.  Section
+// names starting with ! are holes, which are cut out of the polygons whose
+// outer rings contain them.
+func parsePolyFile(content []byte) ([]polygon, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNumber := 0
+	nextLine := func() (string, bool) {
+		for scanner.Scan() {
+			lineNumber += 1
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" {
+				return line, true
+			}
+		}
+		return "", false
+	}
+	lineError := func(message string) error {
+		return errors.New("line " + strconv.Itoa(lineNumber) + " of polygon file: " + message)
+	}
+
+	// the first line names the file
+	_, ok := nextLine()
+	if !ok {
+		return nil, errors.New("empty polygon file")
+	}
+
+	outers := make([]ring, 0, 1)
+	holes := make([]ring, 0)
+	for {
+		sectionName, ok := nextLine()
+		if !ok {
+			return nil, lineError("missing final END")
+		}
+		if sectionName == "END" {
+			break
+		}
+
+		points := make(ring, 0, 100)
+		for {
+			line, ok := nextLine()
+			if !ok {
+				return nil, lineError("missing END of section " + sectionName)
+			}
+			if line == "END" {
+				break
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, lineError("expected a longitude and a latitude")
+			}
+			lon, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return nil, lineError("invalid longitude " + fields[0])
+			}
+			lat, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, lineError("invalid latitude " + fields[1])
+			}
+			points = append(points, [2]float64{lon, lat})
+		}
+		if len(points) < 3 {
+			return nil, lineError("section " + sectionName + " has fewer than three points")
+		}
+
+		if strings.HasPrefix(sectionName, "!") {
+			holes = append(holes, points)
+		} else {
+			outers = append(outers, points)
+		}
+	}
+
+	polygons := make([]polygon, len(outers))
+	for i, outer := range outers {
+		outerHoles := make([]ring, 0)
+		for _, hole := range holes {
+			if outer.containsRing(hole) {
+				outerHoles = append(outerHoles, hole)
+			}
+		}
+		polygons[i] = newPolygon(outer, outerHoles)
+	}
+	return polygons, nil
+}
+
+type geoJSONObject struct {
+	Type        string
+	Coordinates json.RawMessage
+	Geometry    *geoJSONObject
+	Features    []geoJSONObject
+}
+
+func parseGeoJSONPolygons(content []byte) ([]polygon, error) {
+	var object geoJSONObject
+	err := json.Unmarshal(content, &object)
+	if err != nil {
+		return nil, err
+	}
+	return object.polygons()
+}
+
+func (object *geoJSONObject) polygons() ([]polygon, error) {
+	switch object.Type {
+	case "FeatureCollection":
+		polygons := make([]polygon, 0, len(object.Features))
+		for i := range object.Features {
+			featurePolygons, err := object.Features[i].polygons()
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, featurePolygons...)
+		}
+		return polygons, nil
+
+	case "Feature":
+		if object.Geometry == nil {
+			return nil, nil
+		}
+		return object.Geometry.polygons()
+
+	case "Polygon":
+		var rings [][][2]float64
+		err := json.Unmarshal(object.Coordinates, &rings)
+		if err != nil {
+			return nil, err
+		}
+		poly, err := newGeoJSONPolygon(rings)
+		if err != nil {
+			return nil, err
+		}
+		return []polygon{poly}, nil
+
+	case "MultiPolygon":
+		var polygonRings [][][][2]float64
+		err := json.Unmarshal(object.Coordinates, &polygonRings)
+		if err != nil {
+			return nil, err
+		}
+		polygons := make([]polygon, len(polygonRings))
+		for i, rings := range polygonRings {
+			polygons[i], err = newGeoJSONPolygon(rings)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return polygons, nil
+	}
+
+	return nil, errors.New("unsupported GeoJSON type " + object.Type + "; expected a Polygon or MultiPolygon")
+}
+
+// newGeoJSONPolygon builds a polygon from GeoJSON rings, the first of which is
+// the outer ring.
+func newGeoJSONPolygon(rings [][][2]float64) (polygon, error) {
+	if len(rings) == 0 {
+		return polygon{}, errors.New("GeoJSON polygon has no rings")
+	}
+	for _, r := range rings {
+		if len(r) < 3 {
+			return polygon{}, errors.New("GeoJSON polygon ring has fewer than three points")
+		}
+	}
+
+	holes := make([]ring, len(rings)-1)
+	for i, hole := range rings[1:] {
+		holes[i] = hole
+	}
+	return newPolygon(rings[0], holes), nil
+}
@@ -0,0 +1,226 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+// checkPolygons tests which of the points are within polygons.
+func checkPolygons(t *testing.T, name string, polygons []polygon, inside [][2]float64, outside [][2]float64) {
+	t.Helper()
+	for _, point := range inside {
+		if !isInPolygons(polygons, point[0], point[1]) {
+			t.Errorf("%s: %v should be inside", name, point)
+		}
+	}
+	for _, point := range outside {
+		if isInPolygons(polygons, point[0], point[1]) {
+			t.Errorf("%s: %v should be outside", name, point)
+		}
+	}
+}
+
+func TestParsePolyFile(t *testing.T) {
+	content := `islands
+first
+   0 0
+   10 0
+   10 10
+   0 10
+END
+!lake
+   2 2
+   8 2
+   8 8
+   2 8
+END
+island in the lake
+   4 4
+   6 4
+   6 6
+   4 6
+END
+second
+   20 0
+   30 0
+   30 10
+   20 10
+   20 0
+END
+!pond
+   22.5e0 2
+   24 2
+   24 4
+END
+END
+`
+	polygons, err := parsePolyFile([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(polygons) != 3 {
+		t.Fatalf("%d polygons, expected 3", len(polygons))
+	}
+	for i, holeCount := range []int{1, 0, 1} {
+		if len(polygons[i].holes) != holeCount {
+			t.Errorf("polygon %d has %d holes, expected %d", i, len(polygons[i].holes), holeCount)
+		}
+	}
+	checkPolygons(t, "poly", polygons,
+		[][2]float64{{1, 1}, {9, 5}, {5, 5}, {21, 1}, {29, 9}, {23, 3.5}},
+		[][2]float64{{3, 3}, {7, 7}, {15, 5}, {23.5, 2.5}, {-1, 5}, {25, 11}})
+
+	malformed := []string{
+		"",
+		"name\n",
+		"name\nsection\n0 0\n1 0\n1 1\n",
+		"name\nsection\n0 0\n1 0\n1 1\nEND\n",
+		"name\nsection\n0 0 0\n1 0\n1 1\nEND\nEND\n",
+		"name\nsection\nx 0\n1 0\n1 1\nEND\nEND\n",
+		"name\nsection\n0 y\n1 0\n1 1\nEND\nEND\n",
+		"name\nsection\n0 0\n1 0\nEND\nEND\n",
+	}
+	for _, content := range malformed {
+		polygons, err := parsePolyFile([]byte(content))
+		if err == nil {
+			t.Errorf("%q: parsed as %v, expected an error", content, polygons)
+		}
+	}
+}
+
+func TestParseGeoJSONPolygons(t *testing.T) {
+	square := `[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]]`
+	hole := `[[2, 2], [8, 2], [8, 8], [2, 8], [2, 2]]`
+	farSquare := `[[20, 0], [30, 0], [30, 10], [20, 10], [20, 0]]`
+	inside := [][2]float64{{1, 1}, {9, 9}}
+	inHole := [2]float64{5, 5}
+	farPoint := [2]float64{25, 5}
+
+	tests := []struct {
+		name      string
+		content   string
+		count     int
+		inside    [][2]float64
+		outside   [][2]float64
+		malformed bool
+	}{
+		{"polygon", `{"type": "Polygon", "coordinates": [` + square + `]}`, 1, append(inside, inHole), [][2]float64{farPoint}, false},
+		{"polygon with a hole", `{"type": "Polygon", "coordinates": [` + square + `, ` + hole + `]}`, 1, inside, [][2]float64{inHole, farPoint}, false},
+		{"multipolygon", `{"type": "MultiPolygon", "coordinates": [[` + square + `, ` + hole + `], [` + farSquare + `]]}`, 2, append(inside, farPoint), [][2]float64{inHole}, false},
+		{"feature", `{"type": "Feature", "properties": {}, "geometry": {"type": "Polygon", "coordinates": [` + farSquare + `]}}`, 1, [][2]float64{farPoint}, inside, false},
+		{"feature without geometry", `{"type": "Feature", "geometry": null}`, 0, nil, inside, false},
+		{"feature collection", `{"type": "FeatureCollection", "features": [{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [` + square + `]}}, {"type": "Feature", "geometry": {"type": "MultiPolygon", "coordinates": [[` + farSquare + `]]}}]}`, 2, append(inside, farPoint), nil, false},
+		{"point", `{"type": "Point", "coordinates": [1, 1]}`, 0, nil, nil, true},
+		{"no rings", `{"type": "Polygon", "coordinates": []}`, 0, nil, nil, true},
+		{"short ring", `{"type": "Polygon", "coordinates": [[[0, 0], [1, 1]]]}`, 0, nil, nil, true},
+		{"polygon coordinates", `{"type": "MultiPolygon", "coordinates": [` + square + `]}`, 0, nil, nil, true},
+		{"bad feature", `{"type": "FeatureCollection", "features": [{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [[0, 0], [1, 1]]}}]}`, 0, nil, nil, true},
+		{"truncated", `{"type": "Polygon", "coordinates": [` + square, 0, nil, nil, true},
+	}
+
+	for _, test := range tests {
+		polygons, err := parseGeoJSONPolygons([]byte(test.content))
+		if test.malformed {
+			if err == nil {
+				t.Errorf("%s: parsed as %v, expected an error", test.name, polygons)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(polygons) != test.count {
+			t.Errorf("%s: %d polygons, expected %d", test.name, len(polygons), test.count)
+		}
+		checkPolygons(t, test.name, polygons, test.inside, test.outside)
+	}
+}
+
+func TestIsWithinDistance(t *testing.T) {
+	square := ring{{0, 0}, {1, 0}, {1, 1}, {0, 1}}
+	northern := ring{{0, 60}, {1, 60}, {1, 61}, {0, 61}, {0, 60}}
+	degenerate := ring{{0, 0}, {0, 0}, {0, 0}}
+
+	// a thousandth of a degree is about 111 metres at the equator, and half
+	// of that at 60 degrees north
+	tests := []struct {
+		name   string
+		r      ring
+		lon    float64
+		lat    float64
+		metres float64
+		within bool
+	}{
+		{"beside an edge", square, 1.0005, 0.5, 60, true},
+		{"beyond an edge", square, 1.0005, 0.5, 50, false},
+		{"beside the closing edge", square, -0.0005, 0.5, 60, true},
+		{"beside a corner", square, 1.0005, 1.0005, 80, true},
+		{"beyond a corner", square, 1.0005, 1.0005, 75, false},
+		{"inside, far from the edges", square, 0.5, 0.5, 1000, false},
+		{"east at 60 degrees", northern, 1.001, 60.5, 60, true},
+		{"beyond east at 60 degrees", northern, 1.001, 60.5, 50, false},
+		{"north at 60 degrees", northern, 0.5, 61.0005, 50, false},
+		{"a single point", degenerate, 0.0005, 0, 60, true},
+		{"beyond a single point", degenerate, 0.0005, 0, 50, false},
+	}
+
+	for _, test := range tests {
+		if test.r.isWithinDistance(test.lon, test.lat, test.metres) != test.within {
+			t.Errorf("%s: isWithinDistance(%v, %v, %v) should be %v", test.name, test.lon, test.lat, test.metres, test.within)
+		}
+	}
+}
+
+func TestClosedWayPolygons(t *testing.T) {
+	nodeLocations, err := newNodeLocationStore(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nodeLocations.close()
+	for id, location := range map[int64][2]float64{1: {0, 0}, 2: {1, 0}, 3: {1, 1}, 4: {0, 1}, 5: {5, 5}, 6: {6, 6}} {
+		nodeLocations.set(id, location[0], location[1])
+	}
+
+	wayNodeRefs := [][]int64{
+		{1, 2, 3, 4, 1},
+		{1, 2, 3},
+		{1, 2, 99, 1},
+		{5, 6, 5},
+		{5, 6},
+	}
+	boundingBoxes := [][]float64{{0, 0, 1, 1}, {0, 0, 1, 1}, {0, 0, 1, 0}, {5, 5, 6, 6}, nil}
+
+	for _, buffer := range []float64{0, 100} {
+		polygons, remainingBoxes := closedWayPolygons(wayNodeRefs, boundingBoxes, nodeLocations, buffer)
+		if len(polygons) != 1 || polygons[0].buffer != buffer {
+			t.Fatalf("buffer %v: polygons %+v, expected the first way with the buffer", buffer, polygons)
+		}
+		if len(remainingBoxes) != 3 || remainingBoxes[1][2] != 1 || remainingBoxes[2][0] != 5 {
+			t.Errorf("buffer %v: remaining bounding boxes %v, expected those of ways 1 to 3", buffer, remainingBoxes)
+		}
+		if polygons[0].contains(1.0005, 0.5) != (buffer > 0) {
+			t.Errorf("buffer %v: a point 55 metres from the polygon should be inside only with a buffer", buffer)
+		}
+		if !polygons[0].contains(0.5, 0.5) || polygons[0].contains(1.002, 0.5) {
+			t.Errorf("buffer %v: polygon %+v contains the wrong points", buffer, polygons[0])
+		}
+	}
+}
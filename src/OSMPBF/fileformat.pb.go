@@ -13,6 +13,8 @@ type Blob struct {
 	ZlibData          []byte `protobuf:"bytes,3,opt,name=zlib_data" json:"zlib_data,omitempty"`
 	LzmaData          []byte `protobuf:"bytes,4,opt,name=lzma_data" json:"lzma_data,omitempty"`
 	OBSOLETEBzip2Data []byte `protobuf:"bytes,5,opt,name=OBSOLETE_bzip2_data" json:"OBSOLETE_bzip2_data,omitempty"`
+	Lz4Data           []byte `protobuf:"bytes,6,opt,name=lz4_data" json:"lz4_data,omitempty"`
+	ZstdData          []byte `protobuf:"bytes,7,opt,name=zstd_data" json:"zstd_data,omitempty"`
 	XXX_unrecognized  []byte `json:"-"`
 }
 
@@ -43,12 +43,15 @@ func (x Relation_MemberType) String() string {
 }
 
 type HeaderBlock struct {
-	Bbox             *HeaderBBox `protobuf:"bytes,1,opt,name=bbox" json:"bbox,omitempty"`
-	RequiredFeatures []string    `protobuf:"bytes,4,rep,name=required_features" json:"required_features,omitempty"`
-	OptionalFeatures []string    `protobuf:"bytes,5,rep,name=optional_features" json:"optional_features,omitempty"`
-	Writingprogram   *string     `protobuf:"bytes,16,opt,name=writingprogram" json:"writingprogram,omitempty"`
-	Source           *string     `protobuf:"bytes,17,opt,name=source" json:"source,omitempty"`
-	XXX_unrecognized []byte      `json:"-"`
+	Bbox                             *HeaderBBox `protobuf:"bytes,1,opt,name=bbox" json:"bbox,omitempty"`
+	RequiredFeatures                 []string    `protobuf:"bytes,4,rep,name=required_features" json:"required_features,omitempty"`
+	OptionalFeatures                 []string    `protobuf:"bytes,5,rep,name=optional_features" json:"optional_features,omitempty"`
+	Writingprogram                   *string     `protobuf:"bytes,16,opt,name=writingprogram" json:"writingprogram,omitempty"`
+	Source                           *string     `protobuf:"bytes,17,opt,name=source" json:"source,omitempty"`
+	OsmosisReplicationTimestamp      *int64      `protobuf:"varint,32,opt,name=osmosis_replication_timestamp" json:"osmosis_replication_timestamp,omitempty"`
+	OsmosisReplicationSequenceNumber *int64      `protobuf:"varint,33,opt,name=osmosis_replication_sequence_number" json:"osmosis_replication_sequence_number,omitempty"`
+	OsmosisReplicationBaseUrl        *string     `protobuf:"bytes,34,opt,name=osmosis_replication_base_url" json:"osmosis_replication_base_url,omitempty"`
+	XXX_unrecognized                 []byte      `json:"-"`
 }
 
 func (this *HeaderBlock) Reset()         { *this = HeaderBlock{} }
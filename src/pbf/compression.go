@@ -0,0 +1,145 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pbf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz/lzma"
+	"io"
+	"sync"
+)
+
+var errCorruptLz4 = errors.New("corrupt LZ4 data")
+
+var zstdDecoder *zstd.Decoder
+var zstdDecoderErr error
+var zstdDecoderOnce sync.Once
+
+// readDecompressed reads at most one byte beyond rawSize, which is enough
+// for the caller to notice a stream that is longer than advertised.
+func readDecompressed(reader io.Reader, rawSize int32) ([]byte, error) {
+	buffer := bytes.NewBuffer(make([]byte, 0, int(rawSize)+1))
+	_, err := buffer.ReadFrom(io.LimitReader(reader, int64(rawSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decompressZlib(data []byte, rawSize int32) ([]byte, error) {
+	zlibReader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zlibReader.Close()
+	return readDecompressed(zlibReader, rawSize)
+}
+
+// decompressLzma reads the "LZMA alone" format, as written by lzma_alone and
+// xz --format=lzma.
+func decompressLzma(data []byte, rawSize int32) ([]byte, error) {
+	lzmaReader, err := lzma.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return readDecompressed(lzmaReader, rawSize)
+}
+
+func decompressZstd(data []byte, rawSize int32) ([]byte, error) {
+	// a single decoder is safe for concurrent use through DecodeAll
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, zstdDecoderErr = zstd.NewReader(nil)
+	})
+	if zstdDecoderErr != nil {
+		return nil, zstdDecoderErr
+	}
+	return zstdDecoder.DecodeAll(data, make([]byte, 0, rawSize))
+}
+
+// decompressLz4 decodes the LZ4 block format, which carries no size or
+// checksum of its own.
+func decompressLz4(data []byte, rawSize int32) ([]byte, error) {
+	retval := make([]byte, 0, rawSize)
+
+	for i := 0; i < len(data); {
+		token := data[i]
+		i += 1
+
+		literalLength, n, err := readLz4Length(data[i:], int(token>>4))
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		if literalLength > len(data)-i || literalLength > int(rawSize)-len(retval) {
+			return nil, errCorruptLz4
+		}
+		retval = append(retval, data[i:i+literalLength]...)
+		i += literalLength
+
+		// the last sequence is made of literals alone
+		if i == len(data) {
+			break
+		}
+
+		if i+2 > len(data) {
+			return nil, errCorruptLz4
+		}
+		offset := int(data[i]) | int(data[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(retval) {
+			return nil, errCorruptLz4
+		}
+
+		matchLength, n, err := readLz4Length(data[i:], int(token&15))
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		matchLength += 4
+		if matchLength > int(rawSize)-len(retval) {
+			return nil, errCorruptLz4
+		}
+
+		// matches may overlap the bytes they produce, so copy one at a time
+		start := len(retval) - offset
+		for j := 0; j < matchLength; j++ {
+			retval = append(retval, retval[start+j])
+		}
+	}
+
+	return retval, nil
+}
+
+// readLz4Length completes a literal or match length whose first four bits
+// are in a sequence token, returning the length and the bytes consumed.
+func readLz4Length(data []byte, length int) (int, int, error) {
+	if length != 15 {
+		return length, 0, nil
+	}
+	for i, b := range data {
+		length += int(b)
+		if b != 255 {
+			return length, i + 1, nil
+		}
+	}
+	return 0, 0, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,164 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pbf
+
+import (
+	"OSMPBF"
+)
+
+// Info is the metadata of a node, way or relation.
+type Info struct {
+	Version   int32
+	Timestamp int64 // milliseconds since the epoch
+	Changeset int64
+	Uid       int32
+	User      string
+}
+
+type Node struct {
+	Id     int64
+	Lon    float64
+	Lat    float64
+	Keys   []string
+	Values []string
+	Info   *Info
+}
+
+type Way struct {
+	Id      int64
+	NodeIds []int64
+	Keys    []string
+	Values  []string
+	Info    *Info
+}
+
+type Relation struct {
+	Id          int64
+	MemberIds   []int64
+	MemberTypes []OSMPBF.Relation_MemberType
+	MemberRoles []string
+	Keys        []string
+	Values      []string
+	Info        *Info
+}
+
+func calculateTimestamp(primitiveBlock *OSMPBF.PrimitiveBlock, rawTimestamp int64) int64 {
+	var dateGranularity int64 = 1000
+	if primitiveBlock.DateGranularity != nil {
+		dateGranularity = int64(*primitiveBlock.DateGranularity)
+	}
+	return rawTimestamp * dateGranularity
+}
+
+func DecodeInfo(primitiveBlock *OSMPBF.PrimitiveBlock, osmInfo *OSMPBF.Info) *Info {
+	if osmInfo == nil {
+		return nil
+	}
+
+	info := &Info{}
+	if osmInfo.Version != nil {
+		info.Version = *osmInfo.Version
+	}
+	if osmInfo.Timestamp != nil {
+		info.Timestamp = calculateTimestamp(primitiveBlock, *osmInfo.Timestamp)
+	}
+	if osmInfo.Changeset != nil {
+		info.Changeset = *osmInfo.Changeset
+	}
+	if osmInfo.Uid != nil {
+		info.Uid = *osmInfo.Uid
+	}
+	if osmInfo.UserSid != nil {
+		info.User = string(primitiveBlock.Stringtable.S[*osmInfo.UserSid])
+	}
+	return info
+}
+
+func decodeTags(primitiveBlock *OSMPBF.PrimitiveBlock, keyIndexes []uint32, valueIndexes []uint32) ([]string, []string) {
+	keys := make([]string, len(keyIndexes))
+	vals := make([]string, len(keyIndexes))
+	for i, keyIndex := range keyIndexes {
+		valueIndex := valueIndexes[i]
+		keys[i] = string(primitiveBlock.Stringtable.S[keyIndex])
+		vals[i] = string(primitiveBlock.Stringtable.S[valueIndex])
+	}
+	return keys, vals
+}
+
+func DecodeNode(nodeAbs OsmNodeAbstraction) Node {
+	lon, lat := nodeAbs.GetLonLat()
+	keys, vals := nodeAbs.GetKeyValues()
+	return Node{
+		nodeAbs.GetNodeId(),
+		lon,
+		lat,
+		keys,
+		vals,
+		nodeAbs.GetInfo(),
+	}
+}
+
+func DecodeWay(primitiveBlock *OSMPBF.PrimitiveBlock, osmWay *OSMPBF.Way) Way {
+	// delta-decode the node ids
+	nodeRefs := make([]int64, len(osmWay.Refs))
+	var prevNodeId int64 = 0
+	for index, deltaNodeId := range osmWay.Refs {
+		nodeId := prevNodeId + deltaNodeId
+		prevNodeId = nodeId
+		nodeRefs[index] = nodeId
+	}
+
+	keys, vals := decodeTags(primitiveBlock, osmWay.Keys, osmWay.Vals)
+
+	return Way{
+		*osmWay.Id,
+		nodeRefs,
+		keys,
+		vals,
+		DecodeInfo(primitiveBlock, osmWay.Info),
+	}
+}
+
+func DecodeRelation(primitiveBlock *OSMPBF.PrimitiveBlock, osmRelation *OSMPBF.Relation) Relation {
+	// delta-decode the member ids
+	memberIds := make([]int64, len(osmRelation.Memids))
+	var prevMemberId int64 = 0
+	for i, deltaMemberId := range osmRelation.Memids {
+		memberId := prevMemberId + deltaMemberId
+		prevMemberId = memberId
+		memberIds[i] = memberId
+	}
+
+	memberRoles := make([]string, len(osmRelation.RolesSid))
+	for i, roleIndex := range osmRelation.RolesSid {
+		memberRoles[i] = string(primitiveBlock.Stringtable.S[roleIndex])
+	}
+
+	keys, vals := decodeTags(primitiveBlock, osmRelation.Keys, osmRelation.Vals)
+
+	return Relation{
+		*osmRelation.Id,
+		memberIds,
+		osmRelation.Types,
+		memberRoles,
+		keys,
+		vals,
+		DecodeInfo(primitiveBlock, osmRelation.Info),
+	}
+}
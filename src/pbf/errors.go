@@ -0,0 +1,93 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pbf
+
+import (
+	"fmt"
+)
+
+// CorruptHeaderError reports a blob header, or an OSMHeader block, that
+// cannot be decoded.
+type CorruptHeaderError struct {
+	Offset int64
+	Err    error
+}
+
+// TruncatedBlobError reports a file that ends in the middle of a blob.
+type TruncatedBlobError struct {
+	Offset int64
+	Err    error
+}
+
+// CorruptBlockError reports a blob, or the OSMData block within it, that
+// cannot be decoded.
+type CorruptBlockError struct {
+	Offset int64
+	Err    error
+}
+
+// DecompressionError reports compressed blob data that cannot be
+// decompressed, or that decompresses to the wrong size.
+type DecompressionError struct {
+	Offset int64
+	Err    error
+}
+
+// UnsupportedFeatureError reports a required feature, or a blob encoding, that
+// this package cannot read.
+type UnsupportedFeatureError struct {
+	Offset  int64
+	Feature string
+}
+
+func (err *CorruptHeaderError) Error() string {
+	return fmt.Sprintf("corrupt header at offset %d: %s", err.Offset, err.Err)
+}
+
+func (err *CorruptHeaderError) Unwrap() error {
+	return err.Err
+}
+
+func (err *TruncatedBlobError) Error() string {
+	return fmt.Sprintf("truncated blob at offset %d: %s", err.Offset, err.Err)
+}
+
+func (err *TruncatedBlobError) Unwrap() error {
+	return err.Err
+}
+
+func (err *CorruptBlockError) Error() string {
+	return fmt.Sprintf("corrupt block at offset %d: %s", err.Offset, err.Err)
+}
+
+func (err *CorruptBlockError) Unwrap() error {
+	return err.Err
+}
+
+func (err *DecompressionError) Error() string {
+	return fmt.Sprintf("decompression failed for blob at offset %d: %s", err.Offset, err.Err)
+}
+
+func (err *DecompressionError) Unwrap() error {
+	return err.Err
+}
+
+func (err *UnsupportedFeatureError) Error() string {
+	return fmt.Sprintf("unsupported feature at offset %d: %s", err.Offset, err.Feature)
+}
@@ -0,0 +1,272 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pbf
+
+import (
+	"OSMPBF"
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// fixtureBlock builds an OSMData block in memory, one primitive group at a
+// time, keeping the string table as it goes.
+type fixtureBlock struct {
+	block   *OSMPBF.PrimitiveBlock
+	indexes map[string]uint32
+}
+
+func newFixtureBlock() *fixtureBlock {
+	block := &OSMPBF.PrimitiveBlock{Stringtable: &OSMPBF.StringTable{S: [][]byte{{}}}}
+	return &fixtureBlock{block, make(map[string]uint32)}
+}
+
+func (fixture *fixtureBlock) stringIndex(s string) uint32 {
+	index, ok := fixture.indexes[s]
+	if !ok {
+		index = uint32(len(fixture.block.Stringtable.S))
+		fixture.indexes[s] = index
+		fixture.block.Stringtable.S = append(fixture.block.Stringtable.S, []byte(s))
+	}
+	return index
+}
+
+func (fixture *fixtureBlock) tagIndexes(keys []string, values []string) ([]uint32, []uint32) {
+	keyIndexes := make([]uint32, len(keys))
+	valueIndexes := make([]uint32, len(keys))
+	for i, key := range keys {
+		keyIndexes[i] = fixture.stringIndex(key)
+		valueIndexes[i] = fixture.stringIndex(values[i])
+	}
+	return keyIndexes, valueIndexes
+}
+
+// rawCoordinate converts degrees to units of the block's granularity, with its
+// offset removed.
+func (fixture *fixtureBlock) rawCoordinate(degrees float64, offset *int64) int64 {
+	granularity := int64(100)
+	if fixture.block.Granularity != nil {
+		granularity = int64(*fixture.block.Granularity)
+	}
+	nanodegrees := math.Round(degrees * 1e9)
+	if offset != nil {
+		nanodegrees -= float64(*offset)
+	}
+	return int64(math.Round(nanodegrees / float64(granularity)))
+}
+
+func (fixture *fixtureBlock) info(info *Info) *OSMPBF.Info {
+	if info == nil {
+		return nil
+	}
+	dateGranularity := int64(1000)
+	if fixture.block.DateGranularity != nil {
+		dateGranularity = int64(*fixture.block.DateGranularity)
+	}
+	return &OSMPBF.Info{
+		Version:   proto.Int32(info.Version),
+		Timestamp: proto.Int64(info.Timestamp / dateGranularity),
+		Changeset: proto.Int64(info.Changeset),
+		Uid:       proto.Int32(info.Uid),
+		UserSid:   proto.Uint32(fixture.stringIndex(info.User)),
+	}
+}
+
+func (fixture *fixtureBlock) addSparseNodes(nodes ...Node) *fixtureBlock {
+	group := &OSMPBF.PrimitiveGroup{}
+	for _, node := range nodes {
+		keys, values := fixture.tagIndexes(node.Keys, node.Values)
+		group.Nodes = append(group.Nodes, &OSMPBF.Node{
+			Id:   proto.Int64(node.Id),
+			Lon:  proto.Int64(fixture.rawCoordinate(node.Lon, fixture.block.LonOffset)),
+			Lat:  proto.Int64(fixture.rawCoordinate(node.Lat, fixture.block.LatOffset)),
+			Keys: keys,
+			Vals: values,
+			Info: fixture.info(node.Info),
+		})
+	}
+	fixture.block.Primitivegroup = append(fixture.block.Primitivegroup, group)
+	return fixture
+}
+
+// addDenseNodes adds a DenseNodes group, with keys_vals only if withKeysVals
+// is set, and with denseinfo only if every node has metadata.
+func (fixture *fixtureBlock) addDenseNodes(withKeysVals bool, nodes ...Node) *fixtureBlock {
+	dense := &OSMPBF.DenseNodes{}
+	withInfo := len(nodes) != 0
+	for _, node := range nodes {
+		withInfo = withInfo && node.Info != nil
+	}
+	if withInfo {
+		dense.Denseinfo = &OSMPBF.DenseInfo{}
+	}
+
+	var prevId, prevLon, prevLat, prevTimestamp, prevChangeset int64
+	var prevUid, prevUserSid int32
+	for _, node := range nodes {
+		lon := fixture.rawCoordinate(node.Lon, fixture.block.LonOffset)
+		lat := fixture.rawCoordinate(node.Lat, fixture.block.LatOffset)
+		dense.Id = append(dense.Id, node.Id-prevId)
+		dense.Lon = append(dense.Lon, lon-prevLon)
+		dense.Lat = append(dense.Lat, lat-prevLat)
+		prevId, prevLon, prevLat = node.Id, lon, lat
+
+		if withKeysVals {
+			keys, values := fixture.tagIndexes(node.Keys, node.Values)
+			for i := range keys {
+				dense.KeysVals = append(dense.KeysVals, int32(keys[i]), int32(values[i]))
+			}
+			dense.KeysVals = append(dense.KeysVals, 0)
+		}
+
+		if dense.Denseinfo != nil {
+			info := fixture.info(node.Info)
+			userSid := int32(*info.UserSid)
+			dense.Denseinfo.Version = append(dense.Denseinfo.Version, *info.Version)
+			dense.Denseinfo.Timestamp = append(dense.Denseinfo.Timestamp, *info.Timestamp-prevTimestamp)
+			dense.Denseinfo.Changeset = append(dense.Denseinfo.Changeset, *info.Changeset-prevChangeset)
+			dense.Denseinfo.Uid = append(dense.Denseinfo.Uid, *info.Uid-prevUid)
+			dense.Denseinfo.UserSid = append(dense.Denseinfo.UserSid, userSid-prevUserSid)
+			prevTimestamp, prevChangeset, prevUid, prevUserSid = *info.Timestamp, *info.Changeset, *info.Uid, userSid
+		}
+	}
+	fixture.block.Primitivegroup = append(fixture.block.Primitivegroup, &OSMPBF.PrimitiveGroup{Dense: dense})
+	return fixture
+}
+
+func (fixture *fixtureBlock) addWays(ways ...Way) *fixtureBlock {
+	group := &OSMPBF.PrimitiveGroup{}
+	for _, way := range ways {
+		keys, values := fixture.tagIndexes(way.Keys, way.Values)
+		refs := make([]int64, len(way.NodeIds))
+		var prevNodeId int64
+		for i, nodeId := range way.NodeIds {
+			refs[i] = nodeId - prevNodeId
+			prevNodeId = nodeId
+		}
+		group.Ways = append(group.Ways, &OSMPBF.Way{
+			Id:   proto.Int64(way.Id),
+			Keys: keys,
+			Vals: values,
+			Info: fixture.info(way.Info),
+			Refs: refs,
+		})
+	}
+	fixture.block.Primitivegroup = append(fixture.block.Primitivegroup, group)
+	return fixture
+}
+
+func (fixture *fixtureBlock) addRelations(relations ...Relation) *fixtureBlock {
+	group := &OSMPBF.PrimitiveGroup{}
+	for _, relation := range relations {
+		keys, values := fixture.tagIndexes(relation.Keys, relation.Values)
+		memberIds := make([]int64, len(relation.MemberIds))
+		roles := make([]int32, len(relation.MemberIds))
+		var prevMemberId int64
+		for i, memberId := range relation.MemberIds {
+			memberIds[i] = memberId - prevMemberId
+			prevMemberId = memberId
+			roles[i] = int32(fixture.stringIndex(relation.MemberRoles[i]))
+		}
+		group.Relations = append(group.Relations, &OSMPBF.Relation{
+			Id:       proto.Int64(relation.Id),
+			Keys:     keys,
+			Vals:     values,
+			Info:     fixture.info(relation.Info),
+			RolesSid: roles,
+			Memids:   memberIds,
+			Types:    relation.MemberTypes,
+		})
+	}
+	fixture.block.Primitivegroup = append(fixture.block.Primitivegroup, group)
+	return fixture
+}
+
+// decode round-trips the block through its encoding, as it would be read
+// from a file.
+func (fixture *fixtureBlock) decode(tb testing.TB) *OSMPBF.PrimitiveBlock {
+	blockBytes, err := proto.Marshal(fixture.block)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	primitiveBlock, err := DecodePrimitiveBlock(blockBytes, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return primitiveBlock
+}
+
+// encodeFixtureBlob stores content in a blob, raw or compressed with zlib.
+func encodeFixtureBlob(tb testing.TB, content []byte, compression string) []byte {
+	blob := &OSMPBF.Blob{}
+	switch compression {
+	case "raw":
+		blob.Raw = content
+	case "zlib":
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		writer.Write(content)
+		writer.Close()
+		blob.ZlibData = compressed.Bytes()
+		blob.RawSize = proto.Int32(int32(len(content)))
+	default:
+		tb.Fatal("unknown fixture compression " + compression)
+	}
+
+	blobBytes, err := proto.Marshal(blob)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return blobBytes
+}
+
+// fixtureFile builds a PBF file in memory.
+type fixtureFile struct {
+	bytes.Buffer
+}
+
+func (file *fixtureFile) writeBlob(tb testing.TB, blobType string, blobBytes []byte) *fixtureFile {
+	blobHeader, err := proto.Marshal(&OSMPBF.BlobHeader{Type: proto.String(blobType), Datasize: proto.Int32(int32(len(blobBytes)))})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	binary.Write(file, binary.BigEndian, int32(len(blobHeader)))
+	file.Write(blobHeader)
+	file.Write(blobBytes)
+	return file
+}
+
+func (file *fixtureFile) writeHeader(tb testing.TB, header *OSMPBF.HeaderBlock, compression string) *fixtureFile {
+	headerBytes, err := proto.Marshal(header)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return file.writeBlob(tb, "OSMHeader", encodeFixtureBlob(tb, headerBytes, compression))
+}
+
+func (file *fixtureFile) writeBlock(tb testing.TB, fixture *fixtureBlock, compression string) *fixtureFile {
+	blockBytes, err := proto.Marshal(fixture.block)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return file.writeBlob(tb, "OSMData", encodeFixtureBlob(tb, blockBytes, compression))
+}
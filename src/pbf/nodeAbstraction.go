@@ -16,7 +16,7 @@
    along with this program.  If not, see <http://www.gnu.org/licenses/>.
 */
 
-package main
+package pbf
 
 import (
 	"OSMPBF"
@@ -26,6 +26,7 @@ type OsmNodeAbstraction interface {
 	GetNodeId() int64
 	GetLonLat() (float64, float64)
 	GetKeyValues() ([]string, []string)
+	GetInfo() *Info
 }
 
 type sparseOsmNode struct {
@@ -41,6 +42,12 @@ type denseOsmNode struct {
 	rawLat             int64
 	startKeyValueIndex int
 	endKeyValueIndex   int
+	hasInfo            bool
+	version            int32
+	rawTimestamp       int64
+	changeset          int64
+	uid                int32
+	userSid            int32
 }
 
 func calculateLonLat(primitiveBlock *OSMPBF.PrimitiveBlock, rawlon int64, rawlat int64) (float64, float64) {
@@ -86,8 +93,20 @@ func (node *sparseOsmNode) GetKeyValues() ([]string, []string) {
 	return keys, vals
 }
 
-func newDenseOsmNode(osmPrimitiveBlock *OSMPBF.PrimitiveBlock, osmDenseNodes *OSMPBF.DenseNodes, nodeId int64, rawLon int64, rawLat int64, startKeyValIndex int, endKeyValIndex int) OsmNodeAbstraction {
-	return &denseOsmNode{osmPrimitiveBlock, osmDenseNodes, nodeId, rawLon, rawLat, startKeyValIndex, endKeyValIndex}
+func (node *sparseOsmNode) GetInfo() *Info {
+	return DecodeInfo(node.osmPrimitiveBlock, node.osmNode.Info)
+}
+
+func newDenseOsmNode(osmPrimitiveBlock *OSMPBF.PrimitiveBlock, osmDenseNodes *OSMPBF.DenseNodes, nodeId int64, rawLon int64, rawLat int64, startKeyValIndex int, endKeyValIndex int) *denseOsmNode {
+	return &denseOsmNode{
+		osmPrimitiveBlock:  osmPrimitiveBlock,
+		osmDenseNodes:      osmDenseNodes,
+		nodeId:             nodeId,
+		rawLon:             rawLon,
+		rawLat:             rawLat,
+		startKeyValueIndex: startKeyValIndex,
+		endKeyValueIndex:   endKeyValIndex,
+	}
 }
 
 func (node *denseOsmNode) GetNodeId() int64 {
@@ -112,6 +131,22 @@ func (node *denseOsmNode) GetKeyValues() ([]string, []string) {
 	return keys, vals
 }
 
+func (node *denseOsmNode) GetInfo() *Info {
+	if !node.hasInfo {
+		return nil
+	}
+	return &Info{
+		node.version,
+		calculateTimestamp(node.osmPrimitiveBlock, node.rawTimestamp),
+		node.changeset,
+		node.uid,
+		string(node.osmPrimitiveBlock.Stringtable.S[node.userSid]),
+	}
+}
+
+// MakeNodeReader yields the nodes of primitiveBlock, sparse and dense, in the
+// order they are stored.  The block must come from DecodePrimitiveBlock,
+// which ensures that the arrays of its dense nodes are consistent.
 func MakeNodeReader(primitiveBlock *OSMPBF.PrimitiveBlock) <-chan OsmNodeAbstraction {
 	retval := make(chan OsmNodeAbstraction)
 
@@ -127,6 +162,14 @@ func MakeNodeReader(primitiveBlock *OSMPBF.PrimitiveBlock) <-chan OsmNodeAbstrac
 				var prevLon int64 = 0
 				keyValIndex := 0
 
+				// DenseInfo fields other than version are delta-coded too
+				denseInfo := primitiveGroup.Dense.Denseinfo
+				hasDenseInfo := denseInfo != nil && len(denseInfo.Version) != 0
+				var prevTimestamp int64 = 0
+				var prevChangeset int64 = 0
+				var prevUid int32 = 0
+				var prevUserSid int32 = 0
+
 				for idx, deltaNodeId := range primitiveGroup.Dense.Id {
 					nodeId := prevNodeId + deltaNodeId
 					rawlon := prevLon + primitiveGroup.Dense.Lon[idx]
@@ -149,7 +192,23 @@ func MakeNodeReader(primitiveBlock *OSMPBF.PrimitiveBlock) <-chan OsmNodeAbstrac
 						}
 					}
 
-					retval <- newDenseOsmNode(primitiveBlock, primitiveGroup.Dense, nodeId, rawlon, rawlat, startKeyValIndex, keyValIndex)
+					denseNode := newDenseOsmNode(primitiveBlock, primitiveGroup.Dense, nodeId, rawlon, rawlat, startKeyValIndex, keyValIndex)
+
+					if hasDenseInfo {
+						prevTimestamp += denseInfo.Timestamp[idx]
+						prevChangeset += denseInfo.Changeset[idx]
+						prevUid += denseInfo.Uid[idx]
+						prevUserSid += denseInfo.UserSid[idx]
+
+						denseNode.hasInfo = true
+						denseNode.version = denseInfo.Version[idx]
+						denseNode.rawTimestamp = prevTimestamp
+						denseNode.changeset = prevChangeset
+						denseNode.uid = prevUid
+						denseNode.userSid = prevUserSid
+					}
+
+					retval <- denseNode
 
 					keyValIndex += 1
 				}
@@ -0,0 +1,126 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pbf
+
+import (
+	"OSMPBF"
+	"code.google.com/p/goprotobuf/proto"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCalculateLonLat(t *testing.T) {
+	tests := []struct {
+		name   string
+		block  *OSMPBF.PrimitiveBlock
+		rawLon int64
+		rawLat int64
+		lon    float64
+		lat    float64
+	}{
+		{"defaults", &OSMPBF.PrimitiveBlock{}, 1, -1, 0.0000001, -0.0000001},
+		{"extremes", &OSMPBF.PrimitiveBlock{}, 1800000000, -900000000, 180, -90},
+		{"granularity", &OSMPBF.PrimitiveBlock{Granularity: proto.Int32(1000)}, 135, 5250, 0.000135, 0.00525},
+		{"offsets", &OSMPBF.PrimitiveBlock{LonOffset: proto.Int64(-500), LatOffset: proto.Int64(13000000000)}, 20, 0, 0.0000015, 13},
+		{"granularity and offsets", &OSMPBF.PrimitiveBlock{Granularity: proto.Int32(10000), LonOffset: proto.Int64(7), LatOffset: proto.Int64(-7)}, -3, 3, -0.000029993, 0.000029993},
+	}
+
+	for _, test := range tests {
+		lon, lat := calculateLonLat(test.block, test.rawLon, test.rawLat)
+		if math.Abs(lon-test.lon) > 1e-12 || math.Abs(lat-test.lat) > 1e-12 {
+			t.Errorf("%s: %v, %v, expected %v, %v", test.name, lon, lat, test.lon, test.lat)
+		}
+	}
+}
+
+// checkNodes compares decoded nodes with those that were encoded, allowing
+// for the precision of the block's coordinates.
+func checkNodes(t *testing.T, name string, nodes []Node, expected []Node) {
+	t.Helper()
+	if len(nodes) != len(expected) {
+		t.Fatalf("%s: %d nodes, expected %d", name, len(nodes), len(expected))
+	}
+	for i, node := range nodes {
+		want := expected[i]
+		if node.Id != want.Id || math.Abs(node.Lon-want.Lon) > 1e-9 || math.Abs(node.Lat-want.Lat) > 1e-9 {
+			t.Errorf("%s: node %d at %v, %v, expected %d at %v, %v", name, node.Id, node.Lon, node.Lat, want.Id, want.Lon, want.Lat)
+		}
+		if len(node.Keys) != len(want.Keys) || (len(want.Keys) != 0 && (!reflect.DeepEqual(node.Keys, want.Keys) || !reflect.DeepEqual(node.Values, want.Values))) {
+			t.Errorf("%s: node %d has tags %v=%v, expected %v=%v", name, node.Id, node.Keys, node.Values, want.Keys, want.Values)
+		}
+		if !reflect.DeepEqual(node.Info, want.Info) {
+			t.Errorf("%s: node %d has info %+v, expected %+v", name, node.Id, node.Info, want.Info)
+		}
+	}
+}
+
+func untaggedNodes(nodes []Node) []Node {
+	untagged := make([]Node, len(nodes))
+	for i, node := range nodes {
+		untagged[i] = Node{Id: node.Id, Lon: node.Lon, Lat: node.Lat, Info: node.Info}
+	}
+	return untagged
+}
+
+func TestMakeNodeReader(t *testing.T) {
+	nodes := []Node{
+		{Id: 1, Lon: 13.3777041, Lat: 52.5162746, Keys: []string{"amenity", "name"}, Values: []string{"drinking_water", "Brunnen"}},
+		{Id: 2, Lon: -0.1276, Lat: 51.5072},
+		{Id: 17, Lon: -179.9999999, Lat: -89.9999999, Keys: []string{"natural"}, Values: []string{"peak"}},
+		{Id: 9, Lon: 0, Lat: 0},
+	}
+	nodesWithInfo := []Node{
+		{Id: 3, Lon: 1, Lat: 2, Info: &Info{Version: 2, Timestamp: 1349090000000, Changeset: 13, Uid: 7, User: "alice"}},
+		{Id: 5, Lon: 1.5, Lat: 2.5, Keys: []string{"highway"}, Values: []string{"stop"}, Info: &Info{Version: 1, Timestamp: 1349080000000, Changeset: 11, Uid: 9, User: "bob"}},
+	}
+
+	newOffsetBlock := func() *fixtureBlock {
+		fixture := newFixtureBlock()
+		fixture.block.Granularity = proto.Int32(1000)
+		fixture.block.LonOffset = proto.Int64(10000)
+		fixture.block.LatOffset = proto.Int64(-20000)
+		return fixture
+	}
+	offsetNodes := []Node{{Id: 4, Lon: 1.000011, Lat: -2.000022}, {Id: 6, Lon: 0.5, Lat: 0.25}}
+
+	tests := []struct {
+		name     string
+		block    *fixtureBlock
+		expected []Node
+	}{
+		{"sparse", newFixtureBlock().addSparseNodes(nodes...), nodes},
+		{"dense with keys_vals", newFixtureBlock().addDenseNodes(true, nodes...), nodes},
+		{"dense without keys_vals", newFixtureBlock().addDenseNodes(false, nodes...), untaggedNodes(nodes)},
+		{"sparse with info", newFixtureBlock().addSparseNodes(nodesWithInfo...), nodesWithInfo},
+		{"dense with denseinfo", newFixtureBlock().addDenseNodes(true, nodesWithInfo...), nodesWithInfo},
+		{"granularity and offsets, sparse", newOffsetBlock().addSparseNodes(offsetNodes...), offsetNodes},
+		{"granularity and offsets, dense", newOffsetBlock().addDenseNodes(false, offsetNodes...), offsetNodes},
+		{"groups in order", newFixtureBlock().addDenseNodes(false, nodes[1:2]...).addSparseNodes(nodes[2:]...).addWays(Way{Id: 1, NodeIds: []int64{2}}).addDenseNodes(true, nodes[:1]...), []Node{nodes[1], nodes[2], nodes[3], nodes[0]}},
+		{"no nodes", newFixtureBlock().addWays(Way{Id: 1, NodeIds: []int64{2}}), nil},
+	}
+
+	for _, test := range tests {
+		var decoded []Node
+		for nodeAbs := range MakeNodeReader(test.block.decode(t)) {
+			decoded = append(decoded, DecodeNode(nodeAbs))
+		}
+		checkNodes(t, test.name, decoded, test.expected)
+	}
+}
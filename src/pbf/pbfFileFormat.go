@@ -0,0 +1,255 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pbf
+
+import (
+	"OSMPBF"
+	"code.google.com/p/goprotobuf/proto"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BlockData is a raw, still compressed, blob read from a PBF file.
+type BlockData struct {
+	BlobHeader   *OSMPBF.BlobHeader
+	BlobData     []byte
+	FilePosition int64
+}
+
+func readBlock(file io.Reader, size int32) ([]byte, error) {
+	buffer := make([]byte, size)
+	_, err := io.ReadFull(file, buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func ReadNextBlobHeader(file io.Reader) (*OSMPBF.BlobHeader, error) {
+	var blobHeaderSize int32
+
+	err := binary.Read(file, binary.BigEndian, &blobHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if blobHeaderSize < 0 || blobHeaderSize > (64*1024*1024) {
+		return nil, errors.New("invalid blob header size")
+	}
+
+	blobHeaderBytes, err := readBlock(file, blobHeaderSize)
+	if err == io.EOF {
+		// only the end of the file before the size is a clean end
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	blobHeader := &OSMPBF.BlobHeader{}
+	err = proto.Unmarshal(blobHeaderBytes, blobHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	if blobHeader.Type == nil || blobHeader.Datasize == nil || *blobHeader.Datasize < 0 || *blobHeader.Datasize > (32*1024*1024) {
+		return nil, errors.New("invalid blob size")
+	}
+
+	return blobHeader, nil
+}
+
+func DecodeBlob(data BlockData) ([]byte, error) {
+	var blobContent []byte
+
+	blob := &OSMPBF.Blob{}
+	err := proto.Unmarshal(data.BlobData, blob)
+	if err != nil {
+		return nil, &CorruptBlockError{data.FilePosition, err}
+	}
+
+	if blob.Raw != nil {
+		return blob.Raw, nil
+	}
+
+	var decompress func([]byte, int32) ([]byte, error)
+	var compressedData []byte
+	if blob.ZlibData != nil {
+		decompress, compressedData = decompressZlib, blob.ZlibData
+	} else if blob.LzmaData != nil {
+		decompress, compressedData = decompressLzma, blob.LzmaData
+	} else if blob.ZstdData != nil {
+		decompress, compressedData = decompressZstd, blob.ZstdData
+	} else if blob.Lz4Data != nil {
+		decompress, compressedData = decompressLz4, blob.Lz4Data
+	} else {
+		return nil, &UnsupportedFeatureError{data.FilePosition, "blob storage"}
+	}
+
+	if blob.RawSize == nil || *blob.RawSize < 0 {
+		return nil, &DecompressionError{data.FilePosition, errors.New("decompressed size is required but not provided")}
+	}
+	blobContent, err = decompress(compressedData, *blob.RawSize)
+	if err != nil {
+		return nil, &DecompressionError{data.FilePosition, err}
+	}
+	if len(blobContent) != int(*blob.RawSize) {
+		return nil, &DecompressionError{data.FilePosition, errors.New("decompressed size does not match raw_size")}
+	}
+
+	return blobContent, nil
+}
+
+// DecodePrimitiveBlock decodes the decompressed content of the OSMData blob
+// read at filePosition, and ensures that its dense nodes can be read by
+// MakeNodeReader.
+func DecodePrimitiveBlock(blockBytes []byte, filePosition int64) (*OSMPBF.PrimitiveBlock, error) {
+	primitiveBlock := &OSMPBF.PrimitiveBlock{}
+	err := proto.Unmarshal(blockBytes, primitiveBlock)
+	if err != nil {
+		return nil, &CorruptBlockError{filePosition, err}
+	}
+
+	for _, primitiveGroup := range primitiveBlock.Primitivegroup {
+		if primitiveGroup.Dense != nil {
+			err = checkDenseNodes(primitiveGroup.Dense)
+			if err != nil {
+				return nil, &CorruptBlockError{filePosition, err}
+			}
+		}
+	}
+
+	return primitiveBlock, nil
+}
+
+// checkDenseNodes ensures that every array of dense, and of its dense info
+// when it has any, holds a value for each node id, and that keys_vals holds
+// a terminated list of tags for each node when it is not empty.
+func checkDenseNodes(dense *OSMPBF.DenseNodes) error {
+	count := len(dense.Id)
+	if len(dense.Lon) != count || len(dense.Lat) != count {
+		return fmt.Errorf("dense nodes have %d ids, but %d lons and %d lats", count, len(dense.Lon), len(dense.Lat))
+	}
+
+	info := dense.Denseinfo
+	if info != nil && len(info.Version) != 0 {
+		if len(info.Version) != count || len(info.Timestamp) != count || len(info.Changeset) != count || len(info.Uid) != count || len(info.UserSid) != count {
+			return fmt.Errorf("dense nodes have %d ids, but dense info has %d versions, %d timestamps, %d changesets, %d uids and %d user_sids", count, len(info.Version), len(info.Timestamp), len(info.Changeset), len(info.Uid), len(info.UserSid))
+		}
+	}
+
+	if len(dense.KeysVals) != 0 {
+		keyValIndex := 0
+		for i := 0; i < count; i++ {
+			for keyValIndex < len(dense.KeysVals) && dense.KeysVals[keyValIndex] != 0 {
+				keyValIndex += 2
+			}
+			if keyValIndex >= len(dense.KeysVals) {
+				return fmt.Errorf("dense nodes have %d ids, but keys_vals ends within the tags of node %d", count, i)
+			}
+			keyValIndex += 1
+		}
+	}
+
+	return nil
+}
+
+// DecodeHeader decodes an OSMHeader blob, and ensures that every feature it
+// requires is supported.
+func DecodeHeader(data BlockData) (*OSMPBF.HeaderBlock, error) {
+	blockBytes, err := DecodeBlob(data)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &OSMPBF.HeaderBlock{}
+	err = proto.Unmarshal(blockBytes, header)
+	if err != nil {
+		return nil, &CorruptHeaderError{data.FilePosition, err}
+	}
+
+	for _, feat := range header.RequiredFeatures {
+		if feat != "OsmSchema-V0.6" && feat != "DenseNodes" {
+			return nil, &UnsupportedFeatureError{data.FilePosition, feat}
+		}
+	}
+
+	return header, nil
+}
+
+// MakePrimitiveBlockReader reads blobs from file until the end of the file,
+// an error, or the cancellation of ctx.  The block channel is closed when
+// reading stops; the error channel then yields the error, if any, as a
+// *CorruptHeaderError or *TruncatedBlobError for malformed files.
+func MakePrimitiveBlockReader(ctx context.Context, file io.Reader) (<-chan BlockData, <-chan error) {
+	retval := make(chan BlockData)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(retval)
+
+		counter := &countingReader{file, 0}
+		for {
+			filePosition := counter.position
+
+			blobHeader, err := ReadNextBlobHeader(counter)
+			if err == io.EOF {
+				return
+			} else if err == io.ErrUnexpectedEOF {
+				errs <- &TruncatedBlobError{filePosition, err}
+				return
+			} else if err != nil {
+				errs <- &CorruptHeaderError{filePosition, err}
+				return
+			}
+
+			blobBytes, err := readBlock(counter, *blobHeader.Datasize)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				errs <- &TruncatedBlobError{filePosition, io.ErrUnexpectedEOF}
+				return
+			} else if err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case retval <- BlockData{blobHeader, blobBytes, filePosition}:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return retval, errs
+}
+
+type countingReader struct {
+	reader   io.Reader
+	position int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.position += int64(n)
+	return n, err
+}
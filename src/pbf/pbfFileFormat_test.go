@@ -0,0 +1,261 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pbf
+
+import (
+	"OSMPBF"
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"compress/zlib"
+	"context"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz/lzma"
+	"testing"
+)
+
+func isDecompressionError(err error) bool {
+	var target *DecompressionError
+	return errors.As(err, &target)
+}
+
+func isUnsupportedFeatureError(err error) bool {
+	var target *UnsupportedFeatureError
+	return errors.As(err, &target)
+}
+
+func isCorruptBlockError(err error) bool {
+	var target *CorruptBlockError
+	return errors.As(err, &target)
+}
+
+func isCorruptHeaderError(err error) bool {
+	var target *CorruptHeaderError
+	return errors.As(err, &target)
+}
+
+func isTruncatedBlobError(err error) bool {
+	var target *TruncatedBlobError
+	return errors.As(err, &target)
+}
+
+func TestDecodeBlob(t *testing.T) {
+	content := bytes.Repeat([]byte("abc"), 100)
+	rawSize := int32(len(content))
+
+	var zlibData bytes.Buffer
+	zlibWriter := zlib.NewWriter(&zlibData)
+	zlibWriter.Write(content)
+	zlibWriter.Close()
+
+	var lzmaData bytes.Buffer
+	lzmaWriter, err := lzma.NewWriter(&lzmaData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lzmaWriter.Write(content)
+	lzmaWriter.Close()
+
+	zstdEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdData := zstdEncoder.EncodeAll(content, nil)
+
+	// the literals "abc", then a match of the remaining 297 bytes at offset 3
+	lz4Data := []byte{3<<4 | 15, 'a', 'b', 'c', 3, 0, 255, 23}
+
+	tests := []struct {
+		name     string
+		blob     *OSMPBF.Blob
+		expected []byte
+		check    func(error) bool
+	}{
+		{"raw", &OSMPBF.Blob{Raw: content}, content, nil},
+		{"raw with raw_size", &OSMPBF.Blob{Raw: content, RawSize: proto.Int32(rawSize)}, content, nil},
+		{"zlib", &OSMPBF.Blob{ZlibData: zlibData.Bytes(), RawSize: proto.Int32(rawSize)}, content, nil},
+		{"lzma", &OSMPBF.Blob{LzmaData: lzmaData.Bytes(), RawSize: proto.Int32(rawSize)}, content, nil},
+		{"zstd", &OSMPBF.Blob{ZstdData: zstdData, RawSize: proto.Int32(rawSize)}, content, nil},
+		{"lz4", &OSMPBF.Blob{Lz4Data: lz4Data, RawSize: proto.Int32(rawSize)}, content, nil},
+		{"zlib without raw_size", &OSMPBF.Blob{ZlibData: zlibData.Bytes()}, nil, isDecompressionError},
+		{"zlib with short raw_size", &OSMPBF.Blob{ZlibData: zlibData.Bytes(), RawSize: proto.Int32(rawSize - 1)}, nil, isDecompressionError},
+		{"zlib with long raw_size", &OSMPBF.Blob{ZlibData: zlibData.Bytes(), RawSize: proto.Int32(rawSize + 1)}, nil, isDecompressionError},
+		{"corrupt zlib", &OSMPBF.Blob{ZlibData: content, RawSize: proto.Int32(rawSize)}, nil, isDecompressionError},
+		{"zstd with short raw_size", &OSMPBF.Blob{ZstdData: zstdData, RawSize: proto.Int32(rawSize - 1)}, nil, isDecompressionError},
+		{"truncated lz4", &OSMPBF.Blob{Lz4Data: lz4Data[:6], RawSize: proto.Int32(rawSize)}, nil, isDecompressionError},
+		{"lz4 offset before the start", &OSMPBF.Blob{Lz4Data: []byte{1 << 4, 'a', 5, 0}, RawSize: proto.Int32(10)}, nil, isDecompressionError},
+		{"no data", &OSMPBF.Blob{}, nil, isUnsupportedFeatureError},
+		{"obsolete bzip2", &OSMPBF.Blob{OBSOLETEBzip2Data: content, RawSize: proto.Int32(rawSize)}, nil, isUnsupportedFeatureError},
+	}
+
+	for _, test := range tests {
+		blobBytes, err := proto.Marshal(test.blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeBlob(BlockData{BlobData: blobBytes, FilePosition: 42})
+		if test.check != nil {
+			if !test.check(err) {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !bytes.Equal(decoded, test.expected) {
+			t.Errorf("%s: decoded %d bytes, not the expected %d", test.name, len(decoded), len(test.expected))
+		}
+	}
+
+	_, err = DecodeBlob(BlockData{BlobData: []byte{0xff, 0xff, 0xff}, FilePosition: 42})
+	if !isCorruptBlockError(err) {
+		t.Errorf("undecodable blob: unexpected error %v", err)
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		blob  []byte
+		check func(error) bool
+	}{
+		{"supported", encodeFixtureBlob(t, mustMarshal(t, &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes"}}), "zlib"), nil},
+		{"unsupported", encodeFixtureBlob(t, mustMarshal(t, &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "HistoricalInformation"}}), "raw"), isUnsupportedFeatureError},
+		{"corrupt", encodeFixtureBlob(t, []byte{0xff, 0xff, 0xff}, "raw"), isCorruptHeaderError},
+	}
+
+	for _, test := range tests {
+		header, err := DecodeHeader(BlockData{BlobData: test.blob})
+		if test.check != nil {
+			if !test.check(err) {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+		} else if err != nil || len(header.RequiredFeatures) != 2 {
+			t.Errorf("%s: header %v, error %v", test.name, header, err)
+		}
+	}
+}
+
+func TestDecodePrimitiveBlock(t *testing.T) {
+	nodes := []Node{
+		{Id: 3, Lon: 1, Lat: 2, Keys: []string{"highway"}, Values: []string{"stop"}, Info: &Info{Version: 2, Timestamp: 1349090000000, Changeset: 13, Uid: 7, User: "alice"}},
+		{Id: 5, Lon: 1.5, Lat: 2.5, Info: &Info{Version: 1, Timestamp: 1349080000000, Changeset: 11, Uid: 9, User: "bob"}},
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(dense *OSMPBF.DenseNodes)
+		valid   bool
+	}{
+		{"consistent", func(dense *OSMPBF.DenseNodes) {}, true},
+		{"no denseinfo versions", func(dense *OSMPBF.DenseNodes) { dense.Denseinfo.Version = nil }, true},
+		{"short lon", func(dense *OSMPBF.DenseNodes) { dense.Lon = dense.Lon[:1] }, false},
+		{"long lat", func(dense *OSMPBF.DenseNodes) { dense.Lat = append(dense.Lat, 0) }, false},
+		{"short version", func(dense *OSMPBF.DenseNodes) { dense.Denseinfo.Version = dense.Denseinfo.Version[:1] }, false},
+		{"short timestamp", func(dense *OSMPBF.DenseNodes) { dense.Denseinfo.Timestamp = dense.Denseinfo.Timestamp[:1] }, false},
+		{"short changeset", func(dense *OSMPBF.DenseNodes) { dense.Denseinfo.Changeset = nil }, false},
+		{"short uid", func(dense *OSMPBF.DenseNodes) { dense.Denseinfo.Uid = dense.Denseinfo.Uid[:1] }, false},
+		{"short user_sid", func(dense *OSMPBF.DenseNodes) { dense.Denseinfo.UserSid = nil }, false},
+		{"unterminated keys_vals", func(dense *OSMPBF.DenseNodes) { dense.KeysVals = dense.KeysVals[:len(dense.KeysVals)-1] }, false},
+		{"keys_vals without a value", func(dense *OSMPBF.DenseNodes) { dense.KeysVals = dense.KeysVals[:1] }, false},
+	}
+
+	for _, test := range tests {
+		fixture := newFixtureBlock().addDenseNodes(true, nodes...)
+		test.corrupt(fixture.block.Primitivegroup[0].Dense)
+		block, err := DecodePrimitiveBlock(mustMarshal(t, fixture.block), 42)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				continue
+			}
+			count := 0
+			for range MakeNodeReader(block) {
+				count++
+			}
+			if count != len(nodes) {
+				t.Errorf("%s: read %d nodes, expected %d", test.name, count, len(nodes))
+			}
+			continue
+		}
+		var corruptErr *CorruptBlockError
+		if !errors.As(err, &corruptErr) || corruptErr.Offset != 42 {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func mustMarshal(tb testing.TB, message proto.Message) []byte {
+	messageBytes, err := proto.Marshal(message)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return messageBytes
+}
+
+func TestMakePrimitiveBlockReader(t *testing.T) {
+	file := &fixtureFile{}
+	var positions []int64
+	positions = append(positions, int64(file.Len()))
+	file.writeHeader(t, &OSMPBF.HeaderBlock{}, "raw")
+	positions = append(positions, int64(file.Len()))
+	file.writeBlock(t, newFixtureBlock().addSparseNodes(Node{Id: 1}), "zlib")
+	positions = append(positions, int64(file.Len()))
+	file.writeBlock(t, newFixtureBlock().addWays(Way{Id: 1, NodeIds: []int64{1}}), "raw")
+	content := file.Bytes()
+
+	tests := []struct {
+		name       string
+		content    []byte
+		blockCount int
+		check      func(error) bool
+	}{
+		{"complete", content, 3, nil},
+		{"empty", nil, 0, nil},
+		{"truncated blob", content[:len(content)-3], 2, isTruncatedBlobError},
+		{"truncated blob header", content[:positions[2]+6], 2, isTruncatedBlobError},
+		{"blob header size only", content[:positions[2]+4], 2, isTruncatedBlobError},
+		{"corrupt blob header size", append(append([]byte{}, content[:positions[2]]...), 0x7f, 0, 0, 0), 2, isCorruptHeaderError},
+	}
+
+	for _, test := range tests {
+		blocks, errs := MakePrimitiveBlockReader(context.Background(), bytes.NewReader(test.content))
+		blockCount := 0
+		for data := range blocks {
+			if data.FilePosition != positions[blockCount] {
+				t.Errorf("%s: block %d at %d, expected %d", test.name, blockCount, data.FilePosition, positions[blockCount])
+			}
+			if _, err := DecodeBlob(data); err != nil {
+				t.Errorf("%s: block %d: %v", test.name, blockCount, err)
+			}
+			blockCount += 1
+		}
+		err := <-errs
+
+		if blockCount != test.blockCount {
+			t.Errorf("%s: %d blocks read, expected %d", test.name, blockCount, test.blockCount)
+		}
+		if test.check == nil && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.check != nil && !test.check(err) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
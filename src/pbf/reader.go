@@ -0,0 +1,125 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pbf
+
+import (
+	"OSMPBF"
+	"context"
+	"io"
+)
+
+// Reader decodes the nodes, ways and relations of a PBF file, one at a time
+// and in file order.
+type Reader struct {
+	blocks  <-chan BlockData
+	errs    <-chan error
+	ctx     context.Context
+	cancel  context.CancelFunc
+	header  *OSMPBF.HeaderBlock
+	pending []interface{}
+	err     error
+}
+
+// NewReader starts reading the PBF file from file.  Reading stops when ctx is
+// cancelled or the Reader is closed.
+func NewReader(ctx context.Context, file io.Reader) *Reader {
+	ctx, cancel := context.WithCancel(ctx)
+	blocks, errs := MakePrimitiveBlockReader(ctx, file)
+	return &Reader{blocks: blocks, errs: errs, ctx: ctx, cancel: cancel}
+}
+
+// Header returns the file's header block once it has been read by Next, or
+// nil before then.
+func (reader *Reader) Header() *OSMPBF.HeaderBlock {
+	return reader.header
+}
+
+// Next returns the next entity in the file as a *Node, *Way or *Relation.  At
+// the end of the file it returns io.EOF, and once ctx is cancelled ctx.Err();
+// any error is returned on this and every following call.
+func (reader *Reader) Next() (interface{}, error) {
+	if reader.err == nil {
+		reader.err = reader.ctx.Err()
+	}
+	for reader.err == nil && len(reader.pending) == 0 {
+		reader.err = reader.readBlock()
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+
+	entity := reader.pending[0]
+	reader.pending[0] = nil
+	reader.pending = reader.pending[1:]
+	return entity, nil
+}
+
+// Close stops reading the file.
+func (reader *Reader) Close() {
+	reader.cancel()
+	for _ = range reader.blocks {
+	}
+}
+
+func (reader *Reader) readBlock() error {
+	data, ok := <-reader.blocks
+	if !ok {
+		err := <-reader.errs
+		if err == nil {
+			err = io.EOF
+		}
+		return err
+	}
+
+	switch *data.BlobHeader.Type {
+	case "OSMHeader":
+		header, err := DecodeHeader(data)
+		if err != nil {
+			return err
+		}
+		reader.header = header
+
+	case "OSMData":
+		blockBytes, err := DecodeBlob(data)
+		if err != nil {
+			return err
+		}
+		primitiveBlock, err := DecodePrimitiveBlock(blockBytes, data.FilePosition)
+		if err != nil {
+			return err
+		}
+
+		for nodeAbs := range MakeNodeReader(primitiveBlock) {
+			node := DecodeNode(nodeAbs)
+			reader.pending = append(reader.pending, &node)
+		}
+		for _, primitiveGroup := range primitiveBlock.Primitivegroup {
+			for _, osmWay := range primitiveGroup.Ways {
+				way := DecodeWay(primitiveBlock, osmWay)
+				reader.pending = append(reader.pending, &way)
+			}
+			for _, osmRelation := range primitiveGroup.Relations {
+				relation := DecodeRelation(primitiveBlock, osmRelation)
+				reader.pending = append(reader.pending, &relation)
+			}
+		}
+	}
+
+	return nil
+}
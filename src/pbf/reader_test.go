@@ -0,0 +1,131 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pbf
+
+import (
+	"OSMPBF"
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	info := &Info{Version: 3, Timestamp: 1349090000000, Changeset: 21, Uid: 5, User: "carol"}
+	sparseNode := Node{Id: 1, Lon: 0.5, Lat: 0.5, Keys: []string{"amenity"}, Values: []string{"bench"}}
+	denseNodes := []Node{{Id: 2, Lon: 0.6, Lat: 0.5, Keys: []string{"barrier"}, Values: []string{"gate"}}, {Id: 3, Lon: 0.6, Lat: 0.6}}
+	untaggedNodes := []Node{{Id: 4, Lon: -0.5, Lat: -0.5}}
+	way := Way{Id: 10, NodeIds: []int64{1, 2, 3, 1}, Keys: []string{"leisure"}, Values: []string{"golf_course"}, Info: info}
+	relation := Relation{
+		Id:          20,
+		MemberIds:   []int64{10, 4},
+		MemberTypes: []OSMPBF.Relation_MemberType{OSMPBF.Relation_WAY, OSMPBF.Relation_NODE},
+		MemberRoles: []string{"outer", "label"},
+		Keys:        []string{"type"},
+		Values:      []string{"multipolygon"},
+		Info:        info,
+	}
+
+	file := &fixtureFile{}
+	file.writeHeader(t, &OSMPBF.HeaderBlock{RequiredFeatures: []string{"OsmSchema-V0.6", "DenseNodes"}, Source: proto.String("fixture")}, "zlib")
+	file.writeBlock(t, newFixtureBlock().addSparseNodes(sparseNode).addDenseNodes(true, denseNodes...), "raw")
+	file.writeBlock(t, newFixtureBlock().addDenseNodes(false, untaggedNodes...), "zlib")
+	file.writeBlock(t, newFixtureBlock().addWays(way).addRelations(relation), "zlib")
+	content := file.Bytes()
+
+	reader := NewReader(context.Background(), bytes.NewReader(content))
+	defer reader.Close()
+
+	var nodes []Node
+	var entities []interface{}
+	for {
+		entity, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if node, ok := entity.(*Node); ok {
+			nodes = append(nodes, *node)
+		} else {
+			entities = append(entities, entity)
+		}
+	}
+
+	if reader.Header() == nil || reader.Header().Source == nil || *reader.Header().Source != "fixture" {
+		t.Errorf("header %v, expected source fixture", reader.Header())
+	}
+	checkNodes(t, "reader", nodes, append(append([]Node{sparseNode}, denseNodes...), untaggedNodes...))
+	if len(entities) != 2 || !reflect.DeepEqual(entities[0], &way) || !reflect.DeepEqual(entities[1], &relation) {
+		t.Errorf("read %+v, expected way %+v and relation %+v", entities, way, relation)
+	}
+
+	// an error is returned from the point it is found onwards
+	reader = NewReader(context.Background(), bytes.NewReader(content[:len(content)-1]))
+	defer reader.Close()
+	count := 0
+	var err error
+	for err == nil {
+		_, err = reader.Next()
+		count += 1
+	}
+	if !isTruncatedBlobError(err) || count != 5 {
+		t.Errorf("truncated file: error %v after %d entities, expected a truncated blob after 4", err, count-1)
+	}
+	if _, err = reader.Next(); !isTruncatedBlobError(err) {
+		t.Errorf("truncated file: error %v on reading again", err)
+	}
+}
+
+func TestReaderCancellation(t *testing.T) {
+	file := &fixtureFile{}
+	file.writeHeader(t, &OSMPBF.HeaderBlock{}, "raw")
+	for i := int64(0); i < 4; i++ {
+		file.writeBlock(t, newFixtureBlock().addSparseNodes(Node{Id: i*2 + 1}, Node{Id: i*2 + 2}), "zlib")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader := NewReader(ctx, bytes.NewReader(file.Bytes()))
+	defer reader.Close()
+
+	if _, err := reader.Next(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for i := 0; i < 2; i++ {
+		if entity, err := reader.Next(); err != context.Canceled {
+			t.Fatalf("read %+v and error %v after cancellation, expected %v", entity, err, context.Canceled)
+		}
+	}
+
+	// the goroutine reading the file stops of its own accord, without
+	// waiting for Close to take the blocks it has read
+	select {
+	case err := <-reader.errs:
+		if err != context.Canceled {
+			t.Errorf("reading stopped with error %v, expected %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading goroutine still blocked after cancellation")
+	}
+}
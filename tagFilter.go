@@ -0,0 +1,348 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Tag filter expressions select entities by their tags, eg.
+//
+//	leisure=golf_course or (sport=baseball and not access=private)
+//
+// A term is one of:
+//
+//	key              the key is present, with any value
+//	key=v1,v2        the key is present with one of the listed values
+//	key!=v1,v2       the key is absent, or has none of the listed values
+//	key~regexp       the key is present with a value matching the regexp
+//
+// Keys and values may contain * and ? wildcards, and may be quoted with
+// single or double quotes when they contain spaces or operator characters.
+// A regexp must be quoted in the same way when it contains spaces, quotes or
+// any of the characters =!~,() as in name~"^(Old|New) Course$".
+// Terms are combined with not, and, or (in decreasing precedence) and
+// parentheses.
+type tagFilter interface {
+	matches(keys []string, values []string) bool
+}
+
+type andFilter struct {
+	left  tagFilter
+	right tagFilter
+}
+
+type orFilter struct {
+	left  tagFilter
+	right tagFilter
+}
+
+type notFilter struct {
+	operand tagFilter
+}
+
+type tagTermFilter struct {
+	key    stringMatcher
+	values []stringMatcher // nil matches any value
+}
+
+type stringMatcher struct {
+	literal string
+	pattern *regexp.Regexp // nil for an exact match on literal
+}
+
+func (filter *andFilter) matches(keys []string, values []string) bool {
+	return filter.left.matches(keys, values) && filter.right.matches(keys, values)
+}
+
+func (filter *orFilter) matches(keys []string, values []string) bool {
+	return filter.left.matches(keys, values) || filter.right.matches(keys, values)
+}
+
+func (filter *notFilter) matches(keys []string, values []string) bool {
+	return !filter.operand.matches(keys, values)
+}
+
+func (filter *tagTermFilter) matches(keys []string, values []string) bool {
+	for i, key := range keys {
+		if !filter.key.matches(key) {
+			continue
+		}
+		if filter.values == nil {
+			return true
+		}
+		for _, value := range filter.values {
+			if value.matches(values[i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (matcher stringMatcher) matches(s string) bool {
+	if matcher.pattern == nil {
+		return s == matcher.literal
+	}
+	return matcher.pattern.MatchString(s)
+}
+
+func newLiteralMatcher(s string) stringMatcher {
+	return stringMatcher{s, nil}
+}
+
+// newWildcardMatcher treats * and ? in unquoted text as wildcards.
+func newWildcardMatcher(s string) stringMatcher {
+	if !strings.ContainsAny(s, "*?") {
+		return newLiteralMatcher(s)
+	}
+	expr := regexp.QuoteMeta(s)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return stringMatcher{s, regexp.MustCompile("^" + expr + "$")}
+}
+
+func newTagEqualsFilter(key string, value string) tagFilter {
+	return &tagTermFilter{newLiteralMatcher(key), []stringMatcher{newLiteralMatcher(value)}}
+}
+
+const (
+	tokenWord = iota
+	tokenQuoted
+	tokenEquals
+	tokenNotEquals
+	tokenRegexp
+	tokenComma
+	tokenOpenParen
+	tokenCloseParen
+	tokenEnd
+)
+
+type filterToken struct {
+	kind int
+	text string
+}
+
+func tokenizeTagFilter(expression string) ([]filterToken, error) {
+	tokens := make([]filterToken, 0, 16)
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i += 1
+		case c == '=':
+			tokens = append(tokens, filterToken{tokenEquals, "="})
+			i += 1
+		case c == '!' && i+1 < len(expression) && expression[i+1] == '=':
+			tokens = append(tokens, filterToken{tokenNotEquals, "!="})
+			i += 2
+		case c == '~':
+			tokens = append(tokens, filterToken{tokenRegexp, "~"})
+			i += 1
+		case c == ',':
+			tokens = append(tokens, filterToken{tokenComma, ","})
+			i += 1
+		case c == '(':
+			tokens = append(tokens, filterToken{tokenOpenParen, "("})
+			i += 1
+		case c == ')':
+			tokens = append(tokens, filterToken{tokenCloseParen, ")"})
+			i += 1
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(expression[i+1:], c)
+			if end == -1 {
+				return nil, errors.New("unterminated quoted string in filter expression")
+			}
+			tokens = append(tokens, filterToken{tokenQuoted, expression[i+1 : i+1+end]})
+			i += end + 2
+		default:
+			start := i
+			for i < len(expression) && !strings.ContainsRune(" \t\n\r=!~,()\"'", rune(expression[i])) {
+				i += 1
+			}
+			if start == i {
+				return nil, errors.New("unexpected character in filter expression: " + string(c))
+			}
+			tokens = append(tokens, filterToken{tokenWord, expression[start:i]})
+		}
+	}
+	return append(tokens, filterToken{tokenEnd, ""}), nil
+}
+
+type tagFilterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// parseTagFilter compiles a filter expression; see tagFilter for the syntax.
+func parseTagFilter(expression string) (tagFilter, error) {
+	tokens, err := tokenizeTagFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &tagFilterParser{tokens, 0}
+	filter, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek().kind != tokenEnd {
+		return nil, errors.New("unexpected " + parser.peek().text + " in filter expression")
+	}
+	return filter, nil
+}
+
+func (parser *tagFilterParser) peek() filterToken {
+	return parser.tokens[parser.pos]
+}
+
+func (parser *tagFilterParser) next() filterToken {
+	token := parser.tokens[parser.pos]
+	if token.kind != tokenEnd {
+		parser.pos += 1
+	}
+	return token
+}
+
+func (parser *tagFilterParser) peekKeyword(keyword string) bool {
+	token := parser.peek()
+	return token.kind == tokenWord && strings.ToLower(token.text) == keyword
+}
+
+func (parser *tagFilterParser) parseOr() (tagFilter, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peekKeyword("or") {
+		parser.next()
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orFilter{left, right}
+	}
+	return left, nil
+}
+
+func (parser *tagFilterParser) parseAnd() (tagFilter, error) {
+	left, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peekKeyword("and") {
+		parser.next()
+		right, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andFilter{left, right}
+	}
+	return left, nil
+}
+
+func (parser *tagFilterParser) parseUnary() (tagFilter, error) {
+	if parser.peekKeyword("not") {
+		parser.next()
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notFilter{operand}, nil
+	}
+
+	if parser.peek().kind == tokenOpenParen {
+		parser.next()
+		filter, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.next().kind != tokenCloseParen {
+			return nil, errors.New("missing ) in filter expression")
+		}
+		return filter, nil
+	}
+
+	return parser.parseTerm()
+}
+
+func (parser *tagFilterParser) parseTerm() (tagFilter, error) {
+	key, err := parser.parseString()
+	if err != nil {
+		return nil, err
+	}
+
+	switch parser.peek().kind {
+	case tokenEquals, tokenNotEquals:
+		operator := parser.next()
+		values, err := parser.parseValueList()
+		if err != nil {
+			return nil, err
+		}
+		term := &tagTermFilter{key, values}
+		if operator.kind == tokenNotEquals {
+			return &notFilter{term}, nil
+		}
+		return term, nil
+
+	case tokenRegexp:
+		parser.next()
+		token := parser.next()
+		if token.kind != tokenWord && token.kind != tokenQuoted {
+			return nil, errors.New("expected a regular expression after ~ in filter expression")
+		}
+		pattern, err := regexp.Compile(token.text)
+		if err != nil {
+			return nil, err
+		}
+		return &tagTermFilter{key, []stringMatcher{{token.text, pattern}}}, nil
+	}
+
+	return &tagTermFilter{key, nil}, nil
+}
+
+func (parser *tagFilterParser) parseValueList() ([]stringMatcher, error) {
+	values := make([]stringMatcher, 0, 1)
+	for {
+		value, err := parser.parseString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if parser.peek().kind != tokenComma {
+			return values, nil
+		}
+		parser.next()
+	}
+}
+
+func (parser *tagFilterParser) parseString() (stringMatcher, error) {
+	token := parser.next()
+	switch token.kind {
+	case tokenWord:
+		return newWildcardMatcher(token.text), nil
+	case tokenQuoted:
+		return newLiteralMatcher(token.text), nil
+	case tokenEnd:
+		return stringMatcher{}, errors.New("unexpected end of filter expression")
+	}
+	return stringMatcher{}, errors.New("unexpected " + token.text + " in filter expression")
+}
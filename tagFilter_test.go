@@ -0,0 +1,107 @@
+/*
+   go-osmpbf-filter; filtering software for OpenStreetMap PBF files.
+   Copyright (C) 2012  Mathieu Fenniak
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+// splitTags splits alternating keys and values.
+func splitTags(tags []string) ([]string, []string) {
+	keys := make([]string, 0, len(tags)/2)
+	values := make([]string, 0, len(tags)/2)
+	for i := 0; i+1 < len(tags); i += 2 {
+		keys = append(keys, tags[i])
+		values = append(values, tags[i+1])
+	}
+	return keys, values
+}
+
+func TestParseTagFilter(t *testing.T) {
+	tests := []struct {
+		expression string
+		tags       []string
+		matches    bool
+	}{
+		{"leisure", []string{"leisure", "park"}, true},
+		{"leisure", []string{"landuse", "leisure"}, false},
+		{"leisure=golf_course", []string{"name", "Old Course", "leisure", "golf_course"}, true},
+		{"leisure=golf_course", []string{"leisure", "golf_course_x"}, false},
+		{"leisure=park,golf_course", []string{"leisure", "golf_course"}, true},
+		{"leisure=park,golf_course", []string{"leisure", "pitch"}, false},
+		{"access!=private", nil, true},
+		{"access!=private", []string{"access", "yes"}, true},
+		{"access!=private,no", []string{"access", "no"}, false},
+		{"name~^Old", []string{"name", "Old Course"}, true},
+		{"name~^Old", []string{"name", "The Old Course"}, false},
+		{`name~"^(Old|New) Course$"`, []string{"name", "New Course"}, true},
+		{`name~'a=b,c'`, []string{"name", "xa=b,cx"}, true},
+		{"addr:*=1?", []string{"addr:housenumber", "12"}, true},
+		{"addr:*=1?", []string{"addr:housenumber", "123"}, false},
+		{`"addr:*"=12`, []string{"addr:housenumber", "12"}, false},
+		{`"addr:*"=12`, []string{"addr:*", "12"}, true},
+		{`name="Old Course"`, []string{"name", "Old Course"}, true},
+		{"leisure=golf_course or sport=baseball", []string{"sport", "baseball"}, true},
+		{"leisure=golf_course and sport=baseball", []string{"sport", "baseball"}, false},
+		{"not leisure", []string{"sport", "baseball"}, true},
+		{"NOT leisure", []string{"leisure", "park"}, false},
+		{"sport=baseball or leisure=golf_course and access=private", []string{"sport", "baseball"}, true},
+		{"(sport=baseball or leisure=golf_course) and access=private", []string{"sport", "baseball"}, false},
+		{"leisure=golf_course or (sport=baseball and not access=private)", []string{"sport", "baseball", "access", "private"}, false},
+		{"not not leisure", []string{"leisure", "park"}, true},
+	}
+
+	for _, test := range tests {
+		filter, err := parseTagFilter(test.expression)
+		if err != nil {
+			t.Errorf("%q: %v", test.expression, err)
+			continue
+		}
+		keys, values := splitTags(test.tags)
+		if filter.matches(keys, values) != test.matches {
+			t.Errorf("%q matches %v should be %v", test.expression, test.tags, test.matches)
+		}
+	}
+}
+
+func TestParseTagFilterErrors(t *testing.T) {
+	expressions := []string{
+		"",
+		"leisure=",
+		"leisure=park,",
+		"=park",
+		"leisure and",
+		"(leisure",
+		"leisure)",
+		"leisure sport",
+		`name="Old Course`,
+		"name~",
+		"name~(Old",
+		"name~a(b)",
+		"name~[",
+		"leisure!park",
+	}
+
+	for _, expression := range expressions {
+		filter, err := parseTagFilter(expression)
+		if err == nil {
+			t.Errorf("%q: parsed as %+v, expected an error", expression, filter)
+		}
+	}
+}